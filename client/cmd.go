@@ -1,12 +1,29 @@
 package main
 
-import "flag"
+import (
+	"client/util"
+	"flag"
+)
+
+// passwordEnv : environment variable the password of -user is taken from, it is asked for
+// on stdin without it; a password is never given on the command line
+const passwordEnv = "UDPFILE_PASSWORD"
 
 type Cmd struct {
 	Ip          string
 	StoragePath string
 	FileName    string
 	Upload      bool
+	Resume      bool
+	Window      uint
+	Fec         uint
+	Chunk       uint
+	Probe       bool
+	Compress    bool
+	Psk         string
+	KnownHosts  string
+	User        string
+	TokenFile   string
 }
 
 func NewCmd() *Cmd {
@@ -15,6 +32,16 @@ func NewCmd() *Cmd {
 	flag.StringVar(&cmd.StoragePath, "sp", "E:", "-sp D:\\")
 	flag.StringVar(&cmd.FileName, "fn", "t1.txt", "-fn test.txt")
 	flag.BoolVar(&cmd.Upload, "upload", true, "-upload=true")
+	flag.BoolVar(&cmd.Resume, "resume", false, "-resume=true")
+	flag.UintVar(&cmd.Window, "window", util.DefaultWindow, "-window 64")
+	flag.UintVar(&cmd.Fec, "fec", 0, "-fec 8, a parity chunk after every 8 chunks")
+	flag.UintVar(&cmd.Chunk, "chunk", util.DefaultChunkSize, "-chunk 1024, bytes of file data in a chunk")
+	flag.BoolVar(&cmd.Compress, "compress", false, "-compress=true, compress chunks if the server speaks it")
+	flag.BoolVar(&cmd.Probe, "probe", false, "-probe=true, find the largest chunk size the path carries")
+	flag.StringVar(&cmd.Psk, "psk", "", "-psk psk.key, seal all messages with a key derived from the random key in this file, a copy of that of the server")
+	flag.StringVar(&cmd.KnownHosts, "knownhosts", "", "-knownhosts known_hosts, exchange keys with the server first and check its host key against this file")
+	flag.StringVar(&cmd.User, "user", "", "-user alice, act for alice")
+	flag.StringVar(&cmd.TokenFile, "tokenfile", "", "-tokenfile token.txt, file with the base64 token of -user as in the server credentials file, instead of the password")
 	flag.Parse()
 	return cmd
 }
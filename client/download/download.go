@@ -1,9 +1,13 @@
 package download
 
 import (
+	"bytes"
 	"client/util"
+	"client/window"
 	"context"
 	"encoding/binary"
+	"errors"
+	"io"
 	"log"
 	"net"
 	"os"
@@ -11,15 +15,36 @@ import (
 	"time"
 )
 
-func Download(storagePath, fileName string,
+func Download(storagePath, fileName string, resume bool, downloadWindow uint16, fec uint8, chunkSize int, compress bool,
+	credential *util.Credential,
 	recv, send chan util.IMessage,
 	addr *net.UDPAddr, ctx context.Context) {
 	// send init message and wait response
-	initData := make([]byte, util.MessHeadLen)
+	initData := make([]byte, util.InitHeadLen)
 	initData[0] = util.DownloadFlag | util.Init
-	initData = append(initData, []byte(fileName)...)
-	var downloadId, size uint16
-	try := 0
+	initData[util.InitVersionIndex] = util.ProtoVersion
+	if resume {
+		// chunks are requested one by one instead of the whole file being sent
+		initData[util.InitFlagIndex] = util.InitResume
+		// the chunks already here only fit chunks of the same size
+		if stored := stateChunkSize(storagePath, fileName); stored != 0 {
+			chunkSize = stored
+		}
+	}
+	binary.BigEndian.PutUint16(initData[util.InitWindowIndex:util.InitWindowIndex+2], downloadWindow)
+	initData[util.InitFecIndex] = fec
+	caps := uint16(util.Capabilities)
+	if !compress {
+		caps &^= util.CapCompress
+	}
+	binary.BigEndian.PutUint16(initData[util.InitCapIndex:util.InitCapIndex+2], caps)
+	binary.BigEndian.PutUint16(initData[util.InitChunkIndex:util.InitChunkIndex+2], uint16(chunkSize))
+	initData = credential.AppendInit(initData, fileName)
+	var downloadId uint64
+	var size int64
+	var totalLen uint32
+	var digest []byte
+	try := 1
 	for try <= util.MaxDownloadTry {
 		log.Printf("Connect to download file system %s %dth time", fileName, try)
 		try++
@@ -28,43 +53,191 @@ func Download(storagePath, fileName string,
 			Data: initData,
 		}
 		send <- initMess
-		timer := time.NewTicker(time.Second * 2)
-		select {
-		case <-timer.C:
-			continue
-		case resp := <-recv:
-			respData := resp.Data
-			if len(respData) < util.MessHeadLen {
-				continue
+		timer := time.NewTimer(time.Second * 2)
+	wait:
+		for {
+			select {
+			case <-timer.C:
+				break wait
+			case resp := <-recv:
+				respData := resp.Data
+				if len(respData) < util.MessHeadLen {
+					continue
+				}
+				respAck := respData[0] & 0x7f
+				switch respAck {
+				case util.Busy:
+					after, ok := util.BusyWait(respData)
+					if !ok || try > util.MaxDownloadTry {
+						log.Printf("server busy")
+						return
+					}
+					log.Printf("server busy, try again in %s", after)
+					select {
+					case <-time.After(after):
+					case <-ctx.Done():
+						return
+					}
+					break wait
+				case util.FileNoExist:
+					log.Printf("file %s no exists", fileName)
+					return
+				case util.UploadFail:
+					log.Printf("server failed to open %s", fileName)
+					return
+				case util.VersionMismatch:
+					log.Printf("server speaks another protocol version")
+					return
+				case util.CapabilityMismatch:
+					log.Printf("server lacks a capability this client requires")
+					return
+				case util.AuthFail:
+					log.Printf("server does not accept the credentials")
+					return
+				case util.PermissionDenied:
+					log.Printf("not allowed to download %s", fileName)
+					return
+				case util.BadFileName:
+					log.Printf("server refuses the file name %s", fileName)
+					return
+				case util.BadChunkSize:
+					log.Printf("server refuses chunks of %d bytes for %s", chunkSize, fileName)
+					return
+				case util.Retry:
+					if len(respData) != util.RetryLen {
+						continue
+					}
+					// the server wants to know this side receives where it sends from, init again with the cookie
+					copy(initData[util.InitCookieIndex:util.InitCookieIndex+util.CookieLen], respData[util.RetryCookieIndex:])
+					credential.Sign(initData)
+					break wait
+				case util.InitAck:
+				default:
+					// file data may overtake the init ack, keep waiting for it
+					continue
+				}
+				downloadId = binary.BigEndian.Uint64(respData[util.MessIdIndex : util.MessIdIndex+8])
+				totalLen = binary.BigEndian.Uint32(respData[util.MessLenIndex : util.MessLenIndex+4])
+				size = int64(binary.BigEndian.Uint64(respData[util.InitSizeIndex : util.InitSizeIndex+8]))
+				// the server may cut the chunks smaller than asked for
+				chunkSize = int(binary.BigEndian.Uint16(respData[util.InitChunkIndex : util.InitChunkIndex+2]))
+				if chunkSize < util.MinChunkSize {
+					log.Printf("server sent a chunk size of %d", chunkSize)
+					return
+				}
+				if cnt, ok := util.ChunkCount(size, chunkSize); !ok || cnt != totalLen {
+					log.Printf("server sent an inconsistent file size")
+					return
+				}
+				digest = append([]byte(nil), respData[util.InitDigestIndex:util.InitDigestIndex+util.DigestLen]...)
+				if w := binary.BigEndian.Uint16(respData[util.InitWindowIndex : util.InitWindowIndex+2]); w > 0 && w < downloadWindow {
+					downloadWindow = w
+				}
+				// a resumed download gets no parity
+				fec = respData[util.InitFecIndex]
+				caps = binary.BigEndian.Uint16(respData[util.InitCapIndex : util.InitCapIndex+2])
+				try = util.MaxDownloadTry * 2
+				break wait
 			}
-			respAck := respData[0] & 0x7f
-			switch respAck {
-			case util.FileNoExist:
-				log.Printf("file %s no exists", fileName)
-				return
-			case util.InitAck:
-			default:
-				continue
+		}
+		timer.Stop()
+	}
+	if try != util.MaxDownloadTry*2 {
+		log.Printf("Connect fail,exit")
+		return
+	}
+	log.Printf("Begin to download %s in %d byte chunks,wait", fileName, chunkSize)
+	file, received, err := openPart(storagePath, fileName, size, chunkSize, digest, resume)
+	if err != nil {
+		log.Printf("create file %s error：%s", fileName, err.Error())
+		return
+	}
+	downloadFile := util.DownloadFile{
+		FileName: fileName,
+		Size:     size,
+		Digest:   digest,
+		File:     file,
+	}
+	// a resumed download pulls the chunks it lacks, a window of requests at a time
+	var requester *window.Sender
+	request := func() {
+		var indices []uint32
+		for {
+			index, ok := requester.Next(time.Now())
+			if !ok {
+				break
 			}
-			downloadId = binary.BigEndian.Uint16(respData[util.MessIdIndex : util.MessIdIndex+2])
-			size = binary.BigEndian.Uint16(respData[util.MessLenIndex : util.MessLenIndex+2])
-			try = util.MaxDownloadTry * 2
+			indices = append(indices, index)
 		}
+		nack(downloadId, indices, addr, send)
 	}
-	log.Printf("Begin to download %s,wait", fileName)
-	dataSlice := make([][]byte, size)
-	ackMap := make(map[uint16]struct{})
-	ackLen := size
-	// init ackMap
-	for i := uint16(0); i < ackLen; i++ {
-		ackMap[i] = struct{}{}
+	if resume {
+		log.Printf("Resume download, %d of %d chunks already here", received.Count(), totalLen)
+		requester = window.NewSender(totalLen, int(downloadWindow), append(util.Bitmap(nil), received...))
+		request()
 	}
-	timeout := time.Tick(util.DownloadTimeout)
+	// keep the part file resumable if the download is interrupted
+	interrupted := func() {
+		err := saveState(file, size, chunkSize, digest, received)
+		if err != nil {
+			log.Printf("save state of %s error：%s", fileName, err.Error())
+		}
+		file.Close()
+	}
+	ackLen := totalLen
+	remain := totalLen - received.Count()
+	saved := remain
+	// chunks dropped for a bad checksum
+	var corrupt uint32
+	// the server pushing the file learns from SACKs what arrived
+	var low, unacked uint32
+	sack := func() {
+		low = received.FirstClear(low)
+		unacked = 0
+		data := util.SackMessage(received, low)
+		data[0] = util.DownloadFlag | util.Sack
+		binary.BigEndian.PutUint64(data[util.MessIdIndex:util.MessIdIndex+8], downloadId)
+		send <- util.IMessage{
+			Addr: addr,
+			Data: data,
+		}
+	}
+	// answer what arrived, a pushing server gets a SACK and a pulled one the next requests
+	ack := func() {
+		if requester != nil {
+			unacked = 0
+			request()
+		} else {
+			sack()
+		}
+	}
+	// the download fails only if it makes no progress for DownloadTimeout
+	progress := time.Now()
+	// parities of groups still lacking more than one chunk
+	parity := make(util.Parities)
+	decompressor := util.NewDecompressor()
+	// write a chunk to the part file and count it as received
+	put := func(index uint32, chunk []byte) error {
+		_, err := file.WriteAt(chunk, int64(index)*int64(chunkSize))
+		if err != nil {
+			return err
+		}
+		received.Set(index)
+		remain--
+		unacked++
+		progress = time.Now()
+		if requester != nil {
+			requester.Ack(index, time.Now())
+		}
+		return nil
+	}
+	tick := time.NewTicker(util.WindowTick)
+	defer tick.Stop()
 	downloadDisplay := float32(0)
 	for {
-		again := time.Tick(time.Second * 20)
 		select {
 		case <-ctx.Done():
+			interrupted()
 			return
 		case resp := <-recv:
 			respData := resp.Data
@@ -73,77 +246,220 @@ func Download(storagePath, fileName string,
 			}
 			respAck := respData[0] & 0x7f
 			switch respAck {
-			case util.Normal:
+			case util.Normal, util.Parity:
+			case util.Compressed:
+				if caps&util.CapCompress == 0 {
+					continue
+				}
+			case util.UploadFail:
+				if binary.BigEndian.Uint64(respData[util.MessIdIndex:util.MessIdIndex+8]) != downloadId {
+					continue
+				}
+				// the server could not read the file and ended the session, what is here can be resumed
+				log.Printf("server failed to read %s", fileName)
+				interrupted()
+				return
 			default:
 				continue
 			}
-			index := binary.BigEndian.Uint16(respData[util.MessLenIndex : util.MessLenIndex+2])
-			index = index % size
-			_, exist := ackMap[index]
-			if !exist {
+			if !util.ChunkValid(respData) {
+				// damaged on the way, drop it and request it again later
+				corrupt++
 				continue
 			}
-			delete(ackMap, index)
-			dataSlice[index] = append(dataSlice[index], respData[util.MessHeadLen:]...)
-			downloadProcess := float32(ackLen-uint16(len(ackMap))) / float32(ackLen)
+			index := binary.BigEndian.Uint32(respData[util.MessLenIndex : util.MessLenIndex+4])
+			// the group a parity can complete
+			var group uint32
+			if respAck == util.Parity {
+				group = index
+				if fec == 0 || group > util.FecGroup(totalLen-1, fec) ||
+					len(respData)-util.NormalHeadLen != util.ParityLen(size, chunkSize, group, fec) {
+					continue
+				}
+				parity.Add(group, respData[util.NormalHeadLen:])
+			} else {
+				if index >= totalLen {
+					continue
+				}
+				if received.Has(index) {
+					if requester == nil {
+						// sent again, the SACK covering it was lost
+						sack()
+					}
+					continue
+				}
+				chunk := respData[util.NormalHeadLen:]
+				if respAck == util.Compressed {
+					// inflated straight into the chunk, never more than one at a time
+					chunk, err = decompressor.Decompress(respData, util.ChunkLen(size, chunkSize, index))
+					if err != nil {
+						corrupt++
+						continue
+					}
+				}
+				if len(chunk) != util.ChunkLen(size, chunkSize, index) {
+					continue
+				}
+				err = put(index, chunk)
+				if err != nil {
+					// leave it missing, it is sent again
+					log.Printf("write chunk %d error：%s", index, err.Error())
+					continue
+				}
+			}
+			if fec > 0 {
+				if respAck != util.Parity {
+					group = util.FecGroup(index, fec)
+				}
+				// rebuild the chunk lost from the group without waiting for it
+				lost, chunk, ok := parity.Recover(file, size, chunkSize, received, group, fec)
+				if ok {
+					err := put(lost, chunk)
+					if err != nil {
+						log.Printf("write chunk %d error：%s", lost, err.Error())
+					}
+				}
+			}
+			// with parity, wait for the end of a group, a chunk the parity rebuilds is not lost;
+			// the last chunks are acked once the file is stored
+			if remain != 0 && unacked >= util.SackChunks &&
+				(fec == 0 || respAck == util.Parity || util.FecGroupLast(index, totalLen, fec)) {
+				ack()
+			}
+			if saved-remain >= util.StateSaveChunks && remain != 0 {
+				err := saveState(file, size, chunkSize, digest, received)
+				if err != nil {
+					log.Printf("save state of %s error：%s", fileName, err.Error())
+				}
+				saved = remain
+			}
+			downloadProcess := float32(ackLen-remain) / float32(ackLen)
 			if downloadProcess*100 >= downloadDisplay {
 				log.Printf("download process: %.2f%%\n", downloadProcess*100)
 				downloadDisplay += 10
 			}
-			if len(ackMap) == 0 {
+			if remain == 0 {
 				downloadDisplay = 0
-				downloadFile := util.DownloadFile{
-					FileName: fileName,
-					Data:     dataSlice,
+				if corrupt > 0 {
+					log.Printf("dropped %d corrupt chunks", corrupt)
 				}
-				storage(storagePath, downloadFile)
-				return
-			}
-		case <-again:
-			for index, _ := range ackMap {
-				var downloadBytes []byte
-				downloadBytes = append(downloadBytes, util.DownloadFlag|util.DownloadSomeone)
-				idBytes := make([]byte, 2, 2)
-				binary.BigEndian.PutUint16(idBytes, downloadId)
-				downloadBytes = append(downloadBytes, idBytes...)
-				indexLen := make([]byte, 2, 2)
-				binary.BigEndian.PutUint16(indexLen, index)
-				downloadBytes = append(downloadBytes, indexLen...)
-				go func(bytes []byte) {
-					mess := util.IMessage{
+				err := storage(downloadFile)
+				if err == nil {
+					// pushed or pulled, the server ends the session once it learns all chunks are here,
+					// it keeps sending them while the file is not stored yet
+					sack()
+				} else if err == errDigest {
+					// tell the server, the chunks it sent do not add up to its file
+					mismatch := make([]byte, util.MessHeadLen)
+					mismatch[0] = util.DownloadFlag | util.DigestMismatch
+					binary.BigEndian.PutUint64(mismatch[util.MessIdIndex:util.MessIdIndex+8], downloadId)
+					send <- util.IMessage{
 						Addr: addr,
-						Data: bytes,
+						Data: mismatch,
 					}
-					send <- mess
-				}(downloadBytes)
+				}
+				return
+			}
+		case <-tick.C:
+			// a pulling download also requests chunks again that did not come back
+			if unacked > 0 || requester != nil {
+				ack()
+			}
+			if time.Since(progress) > util.DownloadTimeout {
+				log.Printf("download fail with timeout")
+				interrupted()
+				return
 			}
-		case <-timeout:
-			log.Printf("download fail with timeout")
-			return
 		}
 	}
 }
 
-func storage(path string, downloadFile util.DownloadFile) {
+// nack : request the chunks in indices, one NACK for those close enough to share a bitmap
+func nack(downloadId uint64, indices []uint32, addr *net.UDPAddr, send chan util.IMessage) {
+	span := uint32(util.MaxLen * 8)
+	groups := make(map[uint32]util.Bitmap)
+	for _, index := range indices {
+		missing, exist := groups[index/span]
+		if !exist {
+			missing = make(util.Bitmap, util.MaxLen)
+			groups[index/span] = missing
+		}
+		missing.Set(index % span)
+	}
+	for group, missing := range groups {
+		// leave out the empty bytes at both ends
+		begin, end := 0, len(missing)
+		for missing[begin] == 0 {
+			begin++
+		}
+		for missing[end-1] == 0 {
+			end--
+		}
+		data := make([]byte, util.MessHeadLen, util.MessHeadLen+end-begin)
+		data[0] = util.DownloadFlag | util.Nack
+		binary.BigEndian.PutUint64(data[util.MessIdIndex:util.MessIdIndex+8], downloadId)
+		binary.BigEndian.PutUint32(data[util.MessLenIndex:util.MessLenIndex+4], group*span+uint32(begin)*8)
+		send <- util.IMessage{
+			Addr: addr,
+			Data: append(data, missing[begin:end]...),
+		}
+	}
+}
+
+// createFile : create the file chunks are written into, pre-sized to the file size
+func createFile(path, fileName string, size int64) (*os.File, error) {
 	path = strings.TrimRight(path, string(os.PathSeparator))
-	path = path + string(os.PathSeparator) + downloadFile.FileName
+	path = path + string(os.PathSeparator) + fileName
 	try := 0
-	var data []byte
-	for _, bytes := range downloadFile.Data {
-		data = append(data, bytes...)
-	}
+	var err error
 	for try < util.MaxStorageTry {
 		try++
-		f, err := os.Create(path)
+		var f *os.File
+		f, err = os.Create(path)
 		if err != nil {
-			log.Printf("Failed to store %s %dth time", downloadFile.FileName, try)
 			continue
 		}
-		n, err := f.Write(data)
-		if err != nil || n != len(data) {
-			log.Printf("Failed to store %s %dth time", downloadFile.FileName, try)
+		err = f.Truncate(size)
+		if err != nil {
+			f.Close()
 			continue
 		}
-		break
+		return f, nil
+	}
+	return nil, err
+}
+
+// errDigest : the file received does not add up to the digest the server sent
+var errDigest = errors.New("digest does not match")
+
+// storage : verify the digest of the received file and move it into place,
+// errDigest if the digest does not match
+func storage(downloadFile util.DownloadFile) error {
+	part := downloadFile.File.Name()
+	_, err := downloadFile.File.Seek(0, io.SeekStart)
+	var digest []byte
+	if err == nil {
+		digest, err = util.FileDigest(downloadFile.File)
+	}
+	if err != nil {
+		downloadFile.File.Close()
+		log.Printf("Failed to store %s：%s", downloadFile.FileName, err.Error())
+		return err
+	}
+	if !bytes.Equal(digest, downloadFile.Digest) {
+		log.Printf("digest of %s does not match, drop it", downloadFile.FileName)
+		downloadFile.File.Close()
+		os.Remove(part)
+		os.Remove(statePath(part))
+		return errDigest
+	}
+	// a crash before this leaves only the part file, which a later run resumes
+	err = util.Commit(downloadFile.File, strings.TrimSuffix(part, util.PartSuffix))
+	if err != nil {
+		log.Printf("Failed to store %s：%s", downloadFile.FileName, err.Error())
+		return err
 	}
+	os.Remove(statePath(part))
+	log.Printf("download %s success", downloadFile.FileName)
+	return nil
 }
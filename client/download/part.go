@@ -0,0 +1,92 @@
+package download
+
+import (
+	"bytes"
+	"client/util"
+	"encoding/binary"
+	"errors"
+	"log"
+	"os"
+	"strings"
+)
+
+// resume state layout: file size(8) | chunk size(2) | file digest(32) | bitmap of received chunks
+const stateHeadLen = 8 + 2 + util.DigestLen
+
+func partPath(path, fileName string) string {
+	path = strings.TrimRight(path, string(os.PathSeparator))
+	return path + string(os.PathSeparator) + fileName + util.PartSuffix
+}
+
+func statePath(partPath string) string {
+	return partPath + util.StateSuffix
+}
+
+// openPart : open the part file of a download, continuing an earlier download
+// if resume is set and the server file is still the one it was started from
+func openPart(path, fileName string, size int64, chunkSize int, digest []byte, resume bool) (*os.File, util.Bitmap, error) {
+	totalLen, _ := util.ChunkCount(size, chunkSize)
+	part := partPath(path, fileName)
+	if resume {
+		received, err := loadState(part, size, chunkSize, digest)
+		if err == nil {
+			f, err := os.OpenFile(part, os.O_RDWR, 0644)
+			if err == nil {
+				return f, received, nil
+			}
+		} else if !os.IsNotExist(err) {
+			log.Printf("can not resume %s：%s, start over", fileName, err.Error())
+		}
+	}
+	// nothing to continue, start over
+	os.Remove(statePath(part))
+	f, err := createFile(path, fileName+util.PartSuffix, size)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, util.NewBitmap(totalLen), nil
+}
+
+// saveState : flush the part file and record which chunks it holds
+func saveState(file *os.File, size int64, chunkSize int, digest []byte, received util.Bitmap) error {
+	err := file.Sync()
+	if err != nil {
+		return err
+	}
+	data := make([]byte, stateHeadLen, stateHeadLen+len(received))
+	binary.BigEndian.PutUint64(data[:8], uint64(size))
+	binary.BigEndian.PutUint16(data[8:10], uint16(chunkSize))
+	copy(data[10:], digest)
+	data = append(data, received...)
+	state := statePath(file.Name())
+	return util.WriteAtomic(state, data)
+}
+
+func loadState(part string, size int64, chunkSize int, digest []byte) (util.Bitmap, error) {
+	data, err := os.ReadFile(statePath(part))
+	if err != nil {
+		return nil, err
+	}
+	totalLen, _ := util.ChunkCount(size, chunkSize)
+	received := util.NewBitmap(totalLen)
+	if len(data) != stateHeadLen+len(received) {
+		return nil, errors.New("the server file changed")
+	}
+	if int64(binary.BigEndian.Uint64(data[:8])) != size || !bytes.Equal(data[10:stateHeadLen], digest) {
+		return nil, errors.New("the server file changed")
+	}
+	if int(binary.BigEndian.Uint16(data[8:10])) != chunkSize {
+		return nil, errors.New("the chunk size changed")
+	}
+	copy(received, data[stateHeadLen:])
+	return received, nil
+}
+
+// stateChunkSize : chunk size of the download the part file of fileName holds, 0 if there is none
+func stateChunkSize(path, fileName string) int {
+	data, err := os.ReadFile(statePath(partPath(path, fileName)))
+	if err != nil || len(data) < stateHeadLen {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(data[8:10]))
+}
@@ -0,0 +1,92 @@
+package download
+
+import (
+	"bytes"
+	"client/util"
+	"os"
+	"testing"
+)
+
+func TestPartResume(t *testing.T) {
+	dir := t.TempDir()
+	digest := bytes.Repeat([]byte{1}, util.DigestLen)
+	// 10 chunks of 100 bytes, the last one short
+	f, received, err := openPart(dir, "f.bin", 950, 100, digest, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.Count() != 0 {
+		t.Errorf("new part file holds %d chunks", received.Count())
+	}
+	received.Set(0)
+	received.Set(9)
+	if err := saveState(f, 950, 100, digest, received); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if n := stateChunkSize(dir, "f.bin"); n != 100 {
+		t.Errorf("state records chunks of %d bytes", n)
+	}
+
+	other := bytes.Repeat([]byte{2}, util.DigestLen)
+	tests := []struct {
+		name      string
+		size      int64
+		chunkSize int
+		digest    []byte
+		resume    bool
+		chunks    uint32
+	}{
+		{"not resumed", 950, 100, digest, false, 0},
+		{"resumed", 950, 100, digest, true, 2},
+		{"file changed", 950, 100, other, true, 0},
+		{"size changed", 951, 100, digest, true, 0},
+		{"chunk size changed", 950, 200, digest, true, 0},
+	}
+	for _, test := range tests {
+		if err := saveState(mustOpen(t, dir), 950, 100, digest, received); err != nil {
+			t.Fatal(err)
+		}
+		f, got, err := openPart(dir, "f.bin", test.size, test.chunkSize, test.digest, test.resume)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		f.Close()
+		if got.Count() != test.chunks || test.chunks != 0 && !(got.Has(0) && got.Has(9)) {
+			t.Errorf("%s: %d chunks resumed, want %d", test.name, got.Count(), test.chunks)
+		}
+	}
+}
+
+func TestPartBadState(t *testing.T) {
+	dir := t.TempDir()
+	f, _, err := openPart(dir, "f.bin", 950, 100, make([]byte, util.DigestLen), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	part := partPath(dir, "f.bin")
+	if err := os.WriteFile(statePath(part), []byte("short"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadState(part, 950, 100, make([]byte, util.DigestLen)); err == nil {
+		t.Errorf("short state taken")
+	}
+	if n := stateChunkSize(dir, "f.bin"); n != 0 {
+		t.Errorf("short state records chunks of %d bytes", n)
+	}
+	if n := stateChunkSize(dir, "none.bin"); n != 0 {
+		t.Errorf("missing state records chunks of %d bytes", n)
+	}
+}
+
+// mustOpen : the part file of f.bin in dir, opened for writing
+func mustOpen(t *testing.T, dir string) *os.File {
+	t.Helper()
+	f, err := os.OpenFile(partPath(dir, "f.bin"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
@@ -0,0 +1,99 @@
+package handshake
+
+import (
+	"bufio"
+	"bytes"
+	"client/util"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Handshake : exchange ephemeral keys with the server at addr before init, so what follows
+// is sealed under a secret no long-term key reveals. The host key of the server must be
+// the one pinned for host in knownHosts, an unknown host is pinned on first use
+func Handshake(keyring *util.Keyring, knownHosts, host string,
+	recv, send chan util.IMessage, addr *net.UDPAddr, ctx context.Context) error {
+	exchange, hello, err := util.NewExchange(util.UploadFlag)
+	if err != nil {
+		return err
+	}
+	for try := 0; try < util.HelloTry; try++ {
+		send <- util.IMessage{
+			Addr: addr,
+			Data: hello,
+		}
+		timer := time.NewTimer(util.HelloTimeout)
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+				break wait
+			case resp := <-recv:
+				if len(resp.Data) == util.RetryLen && resp.Data[0]&0x7f == util.Retry {
+					// the server exchanges no key before the address proved itself, hello again
+					// with the cookie right away
+					timer.Stop()
+					copy(hello[util.HelloCookieIndex:util.HelloCookieIndex+util.CookieLen], resp.Data[util.RetryCookieIndex:])
+					break wait
+				}
+				if len(resp.Data) < util.MessHeadLen || resp.Data[0]&0x7f != util.HelloAck {
+					continue
+				}
+				timer.Stop()
+				hostKey, secret, err := exchange.Finish(resp.Data)
+				if err != nil {
+					return err
+				}
+				err = checkHost(knownHosts, host, hostKey)
+				if err != nil {
+					return err
+				}
+				keyring.AddPeer(addr, secret)
+				return nil
+			}
+		}
+	}
+	return errors.New("no answer to hello")
+}
+
+// checkHost : whether hostKey is the key pinned for host in knownHosts,
+// one line of host and base64 key each; an unknown host gets pinned
+func checkHost(knownHosts, host string, hostKey ed25519.PublicKey) error {
+	f, err := os.OpenFile(knownHosts, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || fields[0] != host {
+			continue
+		}
+		pinned, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || !bytes.Equal(pinned, hostKey) {
+			return fmt.Errorf("host key of %s changed, remove it from %s if that is expected", host, knownHosts)
+		}
+		return nil
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%s %s\n", host, base64.StdEncoding.EncodeToString(hostKey))
+	if err != nil {
+		return err
+	}
+	log.Printf("pinned host key of %s in %s", host, knownHosts)
+	return nil
+}
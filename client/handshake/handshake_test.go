@@ -0,0 +1,57 @@
+package handshake
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func hostKey(t *testing.T) ed25519.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub
+}
+
+func TestCheckHost(t *testing.T) {
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	pinned := hostKey(t)
+	other := hostKey(t)
+	lines := "other:9091 " + base64.StdEncoding.EncodeToString(other) + "\n" +
+		"bad:9091 not-base64\n"
+	if err := os.WriteFile(knownHosts, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		host string
+		key  ed25519.PublicKey
+		ok   bool
+	}{
+		{"unknown host pinned", "server:9091", pinned, true},
+		{"pinned key", "server:9091", pinned, true},
+		{"changed key", "server:9091", other, false},
+		{"key of another host", "other:9091", pinned, false},
+		{"other host", "other:9091", other, true},
+		{"bad pinned key", "bad:9091", pinned, false},
+	}
+	for _, test := range tests {
+		err := checkHost(knownHosts, test.host, test.key)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: error %v", test.name, err)
+		}
+	}
+	data, err := os.ReadFile(knownHosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "server:9091 "); n != 1 {
+		t.Errorf("server pinned %d times", n)
+	}
+}
@@ -1,15 +1,22 @@
 package main
 
 import (
+	"bufio"
 	"client/download"
+	"client/handshake"
+	"client/probe"
 	"client/recv"
 	"client/send"
 	"client/upload"
 	"client/util"
 	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"strings"
 	"time"
 )
@@ -30,12 +37,35 @@ func main() {
 	uploadChan := make(chan util.IMessage, util.UploadChanCnt)
 	downloadChan := make(chan util.IMessage, util.DownloadChanCnt)
 	sendChan := make(chan util.IMessage, util.SendChanCnt)
+	var psk []byte
+	if cmd.Psk != "" {
+		psk, err = loadPsk(cmd.Psk)
+		if err != nil {
+			log.Printf("err:%s", err.Error())
+			return
+		}
+	}
+	var keyring *util.Keyring
+	if cmd.Psk != "" || cmd.KnownHosts != "" {
+		keyring, err = util.NewKeyring(psk)
+		if err != nil {
+			log.Printf("err:%s", err.Error())
+			return
+		}
+	}
 	bgCtx := context.Background()
 	ctx, cancel := context.WithCancel(bgCtx)
+	// interrupt cancels the transfer, so an interrupted download keeps its resume state
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		cancel()
+	}()
 	// turn on receive module
-	go recv.Recv(udpConn, uploadChan, downloadChan, ctx)
+	go recv.Recv(udpConn, uploadChan, downloadChan, keyring, ctx)
 	// turn on send module
-	go send.Send(udpConn, sendChan, ctx)
+	go send.Send(udpConn, sendChan, keyring, ctx)
 	if !pathExists(cmd.StoragePath) {
 		log.Printf("path %s no exist", cmd.StoragePath)
 		cancel()
@@ -48,19 +78,120 @@ func main() {
 		time.Sleep(util.ExitTime)
 		return
 	}
+	if !cmd.Upload && util.Reserved(cmd.FileName) {
+		log.Printf("file name %s is kept for the state of downloads", cmd.FileName)
+		cancel()
+		time.Sleep(util.ExitTime)
+		return
+	}
+	if cmd.Chunk < util.MinChunkSize || cmd.Chunk > util.MaxChunkSize {
+		log.Printf("chunk size %d out of %d-%d", cmd.Chunk, util.MinChunkSize, util.MaxChunkSize)
+		cancel()
+		time.Sleep(util.ExitTime)
+		return
+	}
+	if cmd.Window < 1 || cmd.Window > util.MaxWindow {
+		log.Printf("window %d out of 1-%d", cmd.Window, util.MaxWindow)
+		cancel()
+		time.Sleep(util.ExitTime)
+		return
+	}
+	if cmd.Fec > util.MaxFec {
+		log.Printf("FEC group %d out of 0-%d", cmd.Fec, util.MaxFec)
+		cancel()
+		time.Sleep(util.ExitTime)
+		return
+	}
+	// asked for before the key exchange, whose key the server keeps only so long unused
+	var credential *util.Credential
+	if cmd.User != "" {
+		credential, err = newCredential(cmd.User, cmd.TokenFile)
+		if err != nil {
+			log.Printf("credentials error：%s", err.Error())
+			cancel()
+			time.Sleep(util.ExitTime)
+			return
+		}
+	}
+	if cmd.KnownHosts != "" {
+		err := handshake.Handshake(keyring, cmd.KnownHosts, cmd.Ip, uploadChan, sendChan, udpAddr, ctx)
+		if err != nil {
+			log.Printf("key exchange error：%s", err.Error())
+			cancel()
+			time.Sleep(util.ExitTime)
+			return
+		}
+	}
+	chunkSize := int(cmd.Chunk)
+	if cmd.Probe {
+		// datagrams larger than the path MTU must be dropped, not fragmented
+		err := probe.DontFragment(udpConn)
+		if err != nil {
+			log.Printf("probe path MTU error：%s", err.Error())
+		} else {
+			chunkSize = probe.Probe(uploadChan, sendChan, udpAddr, ctx)
+			log.Printf("probed chunk size %d", chunkSize)
+		}
+	}
 
 	if cmd.Upload {
 		// upload
-		upload.Upload(cmd.StoragePath, cmd.FileName, uploadChan, sendChan, udpAddr, ctx)
+		upload.Upload(cmd.StoragePath, cmd.FileName, uint16(cmd.Window), uint8(cmd.Fec), chunkSize, cmd.Compress, credential, uploadChan, sendChan, udpAddr, ctx)
 	} else {
 		// download
-		download.Download(cmd.StoragePath, cmd.FileName, downloadChan, sendChan, udpAddr, ctx)
+		download.Download(cmd.StoragePath, cmd.FileName, cmd.Resume, uint16(cmd.Window), uint8(cmd.Fec), chunkSize, cmd.Compress, credential, downloadChan, sendChan, udpAddr, ctx)
 	}
 	cancel()
 	time.Sleep(util.ExitTime)
 	log.Printf("exit...")
 }
 
+// newCredential : credential of user from the token in tokenFile if one is given,
+// or else from its password
+func newCredential(user, tokenFile string) (*util.Credential, error) {
+	if len(user) > util.MaxUserLen {
+		return nil, errors.New("user name too long")
+	}
+	if tokenFile == "" {
+		password, err := readPassword(user)
+		if err != nil {
+			return nil, err
+		}
+		return &util.Credential{User: user, Token: util.UserToken(user, password)}, nil
+	}
+	data, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	return &util.Credential{User: user, Token: raw}, nil
+}
+
+// readPassword : the password of user from passwordEnv, or read from stdin without it
+func readPassword(user string) (string, error) {
+	if password, ok := os.LookupEnv(passwordEnv); ok {
+		return password, nil
+	}
+	fmt.Printf("password of %s: ", user)
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		return "", err
+	}
+	return strings.TrimRight(password, "\r\n"), nil
+}
+
+// loadPsk : the pre-shared key in the file at path, base64 as the server writes it
+func loadPsk(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+}
+
 func pathExists(path string) bool {
 	_, err := os.Stat(path)
 	if err == nil {
@@ -0,0 +1,66 @@
+package probe
+
+import (
+	"client/util"
+	"context"
+	"encoding/binary"
+	"log"
+	"net"
+	"time"
+)
+
+// Probe : largest chunk size whose messages reach the server whole, searched between
+// util.MinChunkSize and util.MaxChunkSize. Datagrams must not be fragmented on the way
+// for the answer to mean anything, see DontFragment
+func Probe(recv, send chan util.IMessage, addr *net.UDPAddr, ctx context.Context) int {
+	// sizes before sealing, sealed probes grow like sealed chunks do
+	low, high := util.MinChunkSize+util.NormalHeadLen, util.NormalHeadLen+util.MaxChunkSize
+	if !through(low, recv, send, addr, ctx) {
+		log.Printf("probe of %d bytes got no answer", low)
+		return util.MinChunkSize
+	}
+	// low always got through, everything above high did not
+	for low < high {
+		mid := (low + high + 1) / 2
+		if through(mid, recv, send, addr, ctx) {
+			low = mid
+		} else {
+			high = mid - 1
+		}
+	}
+	return low - util.NormalHeadLen
+}
+
+// through : whether a probe of size bytes is answered
+func through(size int, recv, send chan util.IMessage, addr *net.UDPAddr, ctx context.Context) bool {
+	data := make([]byte, size)
+	data[0] = util.UploadFlag | util.Probe
+	binary.BigEndian.PutUint32(data[util.MessLenIndex:util.MessLenIndex+4], uint32(size))
+	for try := 0; try < util.ProbeTry; try++ {
+		send <- util.IMessage{
+			Addr: addr,
+			Data: data,
+		}
+		timer := time.NewTimer(util.ProbeTimeout)
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return false
+			case <-timer.C:
+				break wait
+			case resp := <-recv:
+				respData := resp.Data
+				if len(respData) < util.MessHeadLen || respData[0]&0x7f != util.ProbeAck ||
+					binary.BigEndian.Uint32(respData[util.MessLenIndex:util.MessLenIndex+4]) != uint32(size) {
+					// the answer to an earlier probe
+					continue
+				}
+				timer.Stop()
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,29 @@
+//go:build linux
+// +build linux
+
+package probe
+
+import (
+	"net"
+	"syscall"
+)
+
+// DontFragment : forbid fragmenting datagrams of udpConn, one larger than the path MTU is dropped
+func DontFragment(udpConn *net.UDPConn) error {
+	raw, err := udpConn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if addr, ok := udpConn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+			return
+		}
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
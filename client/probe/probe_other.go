@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package probe
+
+import (
+	"errors"
+	"net"
+)
+
+// DontFragment : not supported here, datagrams may be fragmented and probing is pointless
+func DontFragment(udpConn *net.UDPConn) error {
+	return errors.New("not supported on this platform")
+}
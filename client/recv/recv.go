@@ -8,7 +8,9 @@ import (
 	"time"
 )
 
-func Recv(udpConn *net.UDPConn, upload, download chan util.IMessage, ctx context.Context) {
+// Recv : hand the messages read from udpConn to the upload and download modules, those that fail
+// authentication dropped if keyring is not nil
+func Recv(udpConn *net.UDPConn, upload, download chan util.IMessage, keyring *util.Keyring, ctx context.Context) {
 	if udpConn == nil {
 		log.Printf("udpConn is nil\n")
 		return
@@ -20,7 +22,7 @@ func Recv(udpConn *net.UDPConn, upload, download chan util.IMessage, ctx context
 			return
 		default:
 		}
-		data := make([]byte, util.MaxLen+util.MessHeadLen, util.MaxLen+util.MessHeadLen)
+		data := make([]byte, util.MaxDatagram, util.MaxDatagram)
 		// set read timeout
 		udpConn.SetDeadline(time.Now().Add(util.ReadTimeout))
 		n, addr, err := udpConn.ReadFromUDP(data)
@@ -31,20 +33,41 @@ func Recv(udpConn *net.UDPConn, upload, download chan util.IMessage, ctx context
 		if n < util.MessHeadLen {
 			continue
 		}
-		go process(data[:n], upload, download, addr)
+		// hand messages on in the order they arrived, selective acks take reordering for loss
+		process(data[:n], upload, download, keyring, addr, ctx)
 	}
 }
 
-func process(messData []byte, upload, download chan util.IMessage, addr *net.UDPAddr) {
+func process(messData []byte, upload, download chan util.IMessage, keyring *util.Keyring, addr *net.UDPAddr, ctx context.Context) {
+	if keyring != nil {
+		var ok bool
+		messData, ok = keyring.Open(addr, messData)
+		if !ok {
+			// not sealed with the pre-shared key, or forged
+			return
+		}
+	}
 	flag := messData[0] & 0x80
 	mess := util.IMessage{
 		Addr: addr,
 		Data: messData,
 	}
-	switch flag {
-	case util.UploadFlag:
-		upload <- mess
-	case util.DownloadFlag:
-		download <- mess
+	if messData[0]&0x7f == util.Hello {
+		return
+	}
+	if messData[0]&0x7f == util.InitAck {
+		// an incompatible server reaches the module as the error it is
+		if code, ok := util.CheckInitAck(messData); !ok {
+			messData[0] = flag | code
+			mess.Data = messData[:util.MessHeadLen]
+		}
+	}
+	dest := upload
+	if flag == util.DownloadFlag {
+		dest = download
+	}
+	select {
+	case dest <- mess:
+	case <-ctx.Done():
 	}
 }
@@ -7,15 +7,24 @@ import (
 	"net"
 )
 
-func Send(udpConn *net.UDPConn, send chan util.IMessage, ctx context.Context) {
+// Send : write the messages from send to udpConn, sealed if keyring is not nil
+func Send(udpConn *net.UDPConn, send chan util.IMessage, keyring *util.Keyring, ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
 			log.Printf("Send goroutine exit\n")
 			return
 		case mess := <-send:
-			go udpConn.Write(mess.Data)
-
+			data := mess.Data
+			if keyring != nil {
+				data = keyring.Seal(mess.Addr, data)
+				if data == nil {
+					// no key for the peer yet, nothing goes out in the clear
+					continue
+				}
+			}
+			// write in order, selective acks take reordering for loss
+			udpConn.Write(data)
 		}
 	}
 }
@@ -2,8 +2,10 @@ package upload
 
 import (
 	"client/util"
+	"client/window"
 	"context"
 	"encoding/binary"
+	"io"
 	"log"
 	"net"
 	"os"
@@ -11,7 +13,7 @@ import (
 	"time"
 )
 
-func Upload(path, fileName string,
+func Upload(path, fileName string, uploadWindow uint16, fec uint8, chunkSize int, compress bool, credential *util.Credential,
 	recv, send chan util.IMessage,
 	addr *net.UDPAddr, ctx context.Context) {
 	// open file
@@ -27,23 +29,39 @@ func Upload(path, fileName string,
 		log.Printf("get file %s info error：%s", filePath, err.Error())
 		return
 	}
-	fileData := make([]byte, fileStat.Size())
-	n, err := file.Read(fileData)
 	defer file.Close()
+	// send upload info and wait the response
+	size := fileStat.Size()
+	totalLen, ok := util.ChunkCount(size, chunkSize)
+	if !ok {
+		log.Printf("file %s is too large to upload", fileName)
+		return
+	}
+	log.Printf("Digest file %s", fileName)
+	digest, err := util.FileDigest(io.NewSectionReader(file, 0, size))
 	if err != nil {
-		log.Println(err)
+		log.Printf("digest file %s error：%s", filePath, err.Error())
 		return
 	}
-	fileData = fileData[:n]
-	// send upload info and wait the response
-	data := make([]byte, util.MessHeadLen)
-	size := len(fileData)
-	totalLen := uint16((size-1)/util.OnceDownloadSize) + 1
-	binary.BigEndian.PutUint16(data[util.MessLenIndex:util.MessLenIndex+2], totalLen)
+	data := make([]byte, util.InitHeadLen)
+	binary.BigEndian.PutUint32(data[util.MessLenIndex:util.MessLenIndex+4], totalLen)
+	copy(data[util.InitDigestIndex:util.InitDigestIndex+util.DigestLen], digest)
+	data[util.InitVersionIndex] = util.ProtoVersion
+	binary.BigEndian.PutUint64(data[util.InitSizeIndex:util.InitSizeIndex+8], uint64(size))
+	data[util.InitFlagIndex] = util.InitResume
+	binary.BigEndian.PutUint16(data[util.InitWindowIndex:util.InitWindowIndex+2], uploadWindow)
+	data[util.InitFecIndex] = fec
+	caps := uint16(util.Capabilities)
+	if !compress {
+		caps &^= util.CapCompress
+	}
+	binary.BigEndian.PutUint16(data[util.InitCapIndex:util.InitCapIndex+2], caps)
+	binary.BigEndian.PutUint16(data[util.InitChunkIndex:util.InitChunkIndex+2], uint16(chunkSize))
 	data[0] = util.UploadFlag | util.Init
-	data = append(data, []byte(fileName)...)
+	data = credential.AppendInit(data, fileName)
 	try := 1
-	var uploadId uint16
+	var uploadId uint64
+	var resumed bool
 	for try <= util.MaxUploadTry {
 		log.Printf("Connect to upload file system %s %dth time", fileName, try)
 		try++
@@ -64,16 +82,77 @@ func Upload(path, fileName string,
 			respAck := respData[0] & 0x7f
 			switch respAck {
 			case util.Busy:
-				log.Printf("server busy")
-				return
+				after, ok := util.BusyWait(respData)
+				if !ok || try > util.MaxUploadTry {
+					log.Printf("server busy")
+					return
+				}
+				log.Printf("server busy, try again in %s", after)
+				select {
+				case <-time.After(after):
+				case <-ctx.Done():
+					return
+				}
+				continue
 			case util.FileExist:
 				log.Printf("file %s exist", fileName)
 				return
+			case util.VersionMismatch:
+				log.Printf("server speaks another protocol version")
+				return
+			case util.CapabilityMismatch:
+				log.Printf("server lacks a capability this client requires")
+				return
+			case util.UploadFail:
+				log.Printf("server refused file %s", fileName)
+				return
+			case util.AuthFail:
+				log.Printf("server does not accept the credentials")
+				return
+			case util.PermissionDenied:
+				log.Printf("not allowed to upload %s", fileName)
+				return
+			case util.BadFileName:
+				log.Printf("server refuses the file name %s", fileName)
+				return
+			case util.BadChunkSize:
+				log.Printf("server refuses chunks of %d bytes for %s", chunkSize, fileName)
+				return
+			case util.QuotaExceeded:
+				log.Printf("no room on the server for %s", fileName)
+				return
+			case util.Retry:
+				if len(respData) != util.RetryLen {
+					continue
+				}
+				// the server wants to know this side receives where it sends from, init again with the cookie
+				copy(data[util.InitCookieIndex:util.InitCookieIndex+util.CookieLen], respData[util.RetryCookieIndex:])
+				credential.Sign(data)
+				continue
 			case util.InitAck:
 			default:
 				continue
 			}
-			uploadId = binary.BigEndian.Uint16(respData[util.MessIdIndex : util.MessIdIndex+2])
+			uploadId = binary.BigEndian.Uint64(respData[util.MessIdIndex : util.MessIdIndex+8])
+			resumed = respData[util.InitFlagIndex]&util.InitResume != 0
+			// the server may allow fewer chunks in flight than asked for
+			if w := binary.BigEndian.Uint16(respData[util.InitWindowIndex : util.InitWindowIndex+2]); w > 0 && w < uploadWindow {
+				uploadWindow = w
+			}
+			fec = respData[util.InitFecIndex]
+			// the server may not speak all the client offered
+			caps = binary.BigEndian.Uint16(respData[util.InitCapIndex : util.InitCapIndex+2])
+			// the server may cut the chunks smaller, or keep those of the upload it resumes
+			chunkSize = int(binary.BigEndian.Uint16(respData[util.InitChunkIndex : util.InitChunkIndex+2]))
+			if chunkSize < util.MinChunkSize {
+				log.Printf("server sent a chunk size of %d", chunkSize)
+				return
+			}
+			totalLen, ok = util.ChunkCount(size, chunkSize)
+			if !ok || totalLen != binary.BigEndian.Uint32(respData[util.MessLenIndex:util.MessLenIndex+4]) {
+				log.Printf("server sent an inconsistent chunk count")
+				return
+			}
 			try = util.MaxUploadTry * 2
 		}
 	}
@@ -81,49 +160,81 @@ func Upload(path, fileName string,
 		log.Printf("Connect fail,exit")
 		return
 	}
-	log.Printf("Connect success")
-	// Process file data
-	dataSlice := make([][]byte, totalLen)
-	for i, _ := range dataSlice {
-		begin := i * util.OnceDownloadSize
-		end := i*util.OnceDownloadSize + util.OnceDownloadSize
-		if end > len(fileData) {
-			end = len(fileData)
+	log.Printf("Connect success, %d byte chunks", chunkSize)
+	acked := util.NewBitmap(totalLen)
+	if resumed {
+		// the server kept chunks of an earlier upload, only send the others
+		if !queryResume(uploadId, acked, recv, send, addr, ctx) {
+			log.Printf("Query resume state fail,exit")
+			return
 		}
-		dataSlice[i] = append(dataSlice[i], fileData[begin:end]...)
+		log.Printf("Resume upload, server holds %d of %d chunks", acked.Count(), totalLen)
 	}
 	// begin to upload file
 	log.Printf("Begin to upload file %s,wait", fileName)
-	// Send the whole file
-	for i, bytes := range dataSlice {
-		var uploadBytes []byte
-		uploadBytes = append(uploadBytes, util.UploadFlag|util.Normal)
-		idBytes := make([]byte, 2, 2)
-		binary.BigEndian.PutUint16(idBytes, uploadId)
-		uploadBytes = append(uploadBytes, idBytes...)
-		index := make([]byte, 2, 2)
-		binary.BigEndian.PutUint16(index, uint16(i))
-		uploadBytes = append(uploadBytes, index...)
-		uploadBytes = append(uploadBytes, bytes...)
-		go func(bytes []byte) {
-			mess := util.IMessage{
+	sender := window.NewSender(totalLen, int(uploadWindow), acked)
+	// groups before it got their parity already
+	var parityGroup uint32
+	var compressor *util.Compressor
+	if caps&util.CapCompress != 0 {
+		log.Printf("Compress chunks")
+		compressor = util.NewCompressor()
+	}
+	// send as many chunks as the window allows
+	fill := func() bool {
+		for {
+			index, ok := sender.Next(time.Now())
+			if !ok {
+				return true
+			}
+			uploadBytes, err := util.ReadChunk(file, size, chunkSize, index)
+			if err != nil {
+				log.Printf("read chunk %d error：%s", index, err.Error())
+				return false
+			}
+			uploadBytes[0] = util.UploadFlag | util.Normal
+			if compressor != nil {
+				if compressed, ok := compressor.Compress(uploadBytes); ok {
+					uploadBytes = compressed
+					uploadBytes[0] = util.UploadFlag | util.Compressed
+				}
+			}
+			binary.BigEndian.PutUint64(uploadBytes[util.MessIdIndex:util.MessIdIndex+8], uploadId)
+			util.PutChecksum(uploadBytes)
+			send <- util.IMessage{
 				Addr: addr,
-				Data: bytes,
+				Data: uploadBytes,
 			}
-			send <- mess
-		}(uploadBytes)
+			if fec > 0 && util.FecGroupLast(index, totalLen, fec) && util.FecGroup(index, fec) >= parityGroup {
+				// the group was sent the first time, its parity lets the server rebuild a lost chunk of it
+				parityGroup = util.FecGroup(index, fec)
+				parityBytes, err := util.ParityMessage(file, size, chunkSize, parityGroup, fec)
+				if err != nil {
+					log.Printf("read group %d error：%s", parityGroup, err.Error())
+					return false
+				}
+				parityGroup++
+				parityBytes[0] = util.UploadFlag | util.Parity
+				binary.BigEndian.PutUint64(parityBytes[util.MessIdIndex:util.MessIdIndex+8], uploadId)
+				util.PutChecksum(parityBytes)
+				send <- util.IMessage{
+					Addr: addr,
+					Data: parityBytes,
+				}
+			}
+		}
+	}
+	if !fill() {
+		return
 	}
 	// wait response or upload section again
-	ackMap := make(map[uint16]struct{})
 	ackLen := totalLen
-	// init ackMap
-	for i := uint16(0); i < ackLen; i++ {
-		ackMap[i] = struct{}{}
-	}
-	timeout := time.Tick(util.UploadTimeout)
+	tick := time.NewTicker(util.WindowTick)
+	defer tick.Stop()
+	// the upload fails only if it makes no progress for UploadTimeout
+	progress := time.Now()
 	uploadDisplay := float32(0)
 	for {
-		again := time.Tick(time.Second * 20)
 		select {
 		case <-ctx.Done():
 			log.Printf("ctx done,return")
@@ -135,46 +246,157 @@ func Upload(path, fileName string,
 			}
 			respAck := respData[0] & 0x7f
 			switch respAck {
-			case util.NormalAck:
-				index := binary.BigEndian.Uint16(respData[util.MessLenIndex : util.MessLenIndex+2])
-				delete(ackMap, index)
-				uploadProcess := float32(ackLen-uint16(len(ackMap))) / float32(ackLen)
+			case util.Sack:
+				base := binary.BigEndian.Uint32(respData[util.MessLenIndex : util.MessLenIndex+4])
+				if sender.Sack(base, respData[util.MessHeadLen:], time.Now()) == 0 {
+					continue
+				}
+				progress = time.Now()
+				uploadProcess := float32(ackLen-sender.Remain()) / float32(ackLen)
 				if uploadProcess*100 >= uploadDisplay {
 					log.Printf("upload process: %.2f%%\n", uploadProcess*100)
 					uploadDisplay += 10
 				}
-				if len(ackMap) == 0 {
+				if sender.Done() {
 					uploadDisplay = 0
+					// the file is only uploaded once the server stored it
+					if waitCommit(uploadId, recv, send, addr, ctx) {
+						log.Printf("upload %s success", fileName)
+					}
 					return
 				}
+				if !fill() {
+					return
+				}
+			case util.UploadCommitted:
+				if binary.BigEndian.Uint64(respData[util.MessIdIndex:util.MessIdIndex+8]) != uploadId {
+					continue
+				}
+				// the SACK of the last chunks got lost, but the file is stored
+				log.Printf("upload %s success", fileName)
+				return
 			case util.UploadFail:
 				log.Printf("upload file fail")
 				return
+			case util.UploadCommitFailed:
+				if binary.BigEndian.Uint64(respData[util.MessIdIndex:util.MessIdIndex+8]) != uploadId {
+					continue
+				}
+				log.Printf("upload file fail, server could not store %s", fileName)
+				return
+			case util.DigestMismatch:
+				log.Printf("upload file fail, server digest of %s does not match", fileName)
+				return
+			case util.QuotaExceeded:
+				log.Printf("upload file fail, server ran out of room for %s, resume once there is", fileName)
+				return
 			default:
 			}
-		case <-again:
-			for index, _ := range ackMap {
-				var uploadBytes []byte
-				uploadBytes = append(uploadBytes, util.UploadFlag|util.Normal)
-				idBytes := make([]byte, 2, 2)
-				binary.BigEndian.PutUint16(idBytes, uploadId)
-				uploadBytes = append(uploadBytes, idBytes...)
-				indexLen := make([]byte, 2, 2)
-				binary.BigEndian.PutUint16(indexLen, index)
-				uploadBytes = append(uploadBytes, indexLen...)
-				uploadBytes = append(uploadBytes, dataSlice[index]...)
-				go func(bytes []byte) {
-					mess := util.IMessage{
-						Addr: addr,
-						Data: bytes,
-					}
-					send <- mess
-				}(uploadBytes)
+		case <-tick.C:
+			// send chunks whose ack did not come back again
+			if !fill() {
+				return
+			}
+			if time.Since(progress) > util.UploadTimeout {
+				log.Printf("upload fail with timeout")
+				return
 			}
-		case <-timeout:
-			log.Printf("upload fail with timeout")
-			return
 		}
 	}
 	//log.Printf("finshed upload")
 }
+
+// waitCommit : ask the server until it tells how the upload whose chunks it all acked ended,
+// true if it stored the file
+func waitCommit(uploadId uint64, recv, send chan util.IMessage, addr *net.UDPAddr, ctx context.Context) bool {
+	query := make([]byte, util.MessHeadLen)
+	query[0] = util.UploadFlag | util.UploadCommitted
+	binary.BigEndian.PutUint64(query[util.MessIdIndex:util.MessIdIndex+8], uploadId)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	// the server answers busy while it is still storing the file
+	answered := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer.C:
+			if time.Since(answered) > util.CommitTimeout {
+				log.Printf("upload fail, server did not tell whether it stored the file")
+				return false
+			}
+			send <- util.IMessage{
+				Addr: addr,
+				Data: query,
+			}
+			timer.Reset(util.CommitRetry)
+		case resp := <-recv:
+			respData := resp.Data
+			if len(respData) < util.MessHeadLen ||
+				binary.BigEndian.Uint64(respData[util.MessIdIndex:util.MessIdIndex+8]) != uploadId {
+				continue
+			}
+			switch respData[0] & 0x7f {
+			case util.UploadCommitted:
+				return true
+			case util.UploadCommitFailed:
+				log.Printf("upload fail, server could not store the file")
+				return false
+			case util.DigestMismatch:
+				log.Printf("upload fail, server digest does not match")
+				return false
+			case util.Busy:
+				answered = time.Now()
+				if after, ok := util.BusyWait(respData); ok {
+					if !timer.Stop() {
+						<-timer.C
+					}
+					timer.Reset(after)
+				}
+			}
+		}
+	}
+}
+
+// queryResume : fetch the bitmap of chunks the server already holds into acked
+func queryResume(uploadId uint64, acked util.Bitmap,
+	recv, send chan util.IMessage, addr *net.UDPAddr, ctx context.Context) bool {
+	for begin := 0; begin < len(acked); begin += util.MaxLen {
+		query := make([]byte, util.MessHeadLen)
+		query[0] = util.UploadFlag | util.ResumeQuery
+		binary.BigEndian.PutUint64(query[util.MessIdIndex:util.MessIdIndex+8], uploadId)
+		binary.BigEndian.PutUint32(query[util.MessLenIndex:util.MessLenIndex+4], uint32(begin)*8)
+		got := false
+		for try := 1; try <= util.MaxUploadTry && !got; try++ {
+			send <- util.IMessage{
+				Addr: addr,
+				Data: query,
+			}
+			timer := time.NewTimer(time.Second * 2)
+		wait:
+			for {
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return false
+				case <-timer.C:
+					break wait
+				case resp := <-recv:
+					respData := resp.Data
+					if len(respData) < util.MessHeadLen || respData[0]&0x7f != util.ResumeState ||
+						binary.BigEndian.Uint32(respData[util.MessLenIndex:util.MessLenIndex+4]) != uint32(begin)*8 {
+						continue
+					}
+					copy(acked[begin:], respData[util.MessHeadLen:])
+					got = true
+					break wait
+				}
+			}
+			timer.Stop()
+		}
+		if !got {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,46 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Commit : flush f, close it and rename it to name, then flush the directory, so that after
+// a crash name is either missing or whole
+func Commit(f *os.File, name string) error {
+	err := f.Sync()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(f.Name(), name)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(name))
+}
+
+// WriteAtomic : replace the file name by data, through a temporary file next to it
+func WriteAtomic(name string, data []byte) error {
+	f, err := os.OpenFile(name+TmpSuffix, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	return Commit(f, name)
+}
+
+// Reserved : whether the file name ends like a part file, a state or a state being written,
+// which a download of that name would clash with
+func Reserved(name string) bool {
+	return strings.HasSuffix(name, PartSuffix) || strings.HasSuffix(name, StateSuffix) ||
+		strings.HasSuffix(name, StateSuffix+TmpSuffix)
+}
@@ -0,0 +1,66 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteAtomic(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "f.bin"+StateSuffix)
+	for _, data := range []string{"first state", "second"} {
+		if err := WriteAtomic(name, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != data {
+			t.Errorf("file holds %q, want %q", got, data)
+		}
+		if _, err := os.Stat(name + TmpSuffix); !os.IsNotExist(err) {
+			t.Errorf("temporary file left: %v", err)
+		}
+	}
+}
+
+func TestCommit(t *testing.T) {
+	dir := t.TempDir()
+	f, err := os.Create(filepath.Join(dir, "f.bin"+PartSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString("data"); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "f.bin")
+	if err := Commit(f, name); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(name); err != nil || string(got) != "data" {
+		t.Errorf("committed file holds %q, %v", got, err)
+	}
+	if _, err := os.Stat(f.Name()); !os.IsNotExist(err) {
+		t.Errorf("part file left: %v", err)
+	}
+}
+
+func TestReserved(t *testing.T) {
+	tests := []struct {
+		name     string
+		reserved bool
+	}{
+		{"f.bin", false},
+		{"f.bin" + PartSuffix, true},
+		{"f.bin" + StateSuffix, true},
+		{"f.bin" + StateSuffix + TmpSuffix, true},
+		// only a state is written through a temporary file
+		{"f.bin" + TmpSuffix, false},
+	}
+	for _, test := range tests {
+		if reserved := Reserved(test.name); reserved != test.reserved {
+			t.Errorf("Reserved(%q) = %v, want %v", test.name, reserved, test.reserved)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+)
+
+// UserToken : the token user proves itself with, derived from its password. Whoever holds
+// the token can act as user as well as with the password, tokens are kept as secret
+func UserToken(user, password string) []byte {
+	return derive([]byte(password), []byte("user "+user))
+}
+
+// initProof : HMAC-SHA256 with token over the init message in data, leaving out the
+// capabilities and salts the way may change and the proof itself. The cookie is signed,
+// a proof is only good from the address the server sent the cookie to
+func initProof(data, token []byte) []byte {
+	mac := hmac.New(sha256.New, token)
+	mac.Write(data[:InitCapIndex])
+	mac.Write(make([]byte, InitCookieIndex-InitCapIndex))
+	mac.Write(data[InitCookieIndex:])
+	return mac.Sum(nil)
+}
+
+// Credential : who the client acts for, nil for nobody
+type Credential struct {
+	User  string
+	Token []byte
+}
+
+// AppendInit : append the user and fileName to the init head in data and sign it
+func (c *Credential) AppendInit(data []byte, fileName string) []byte {
+	if c != nil {
+		data[InitUserLenIndex] = uint8(len(c.User))
+		data = append(data, []byte(c.User)...)
+	}
+	data = append(data, []byte(fileName)...)
+	c.Sign(data)
+	return data
+}
+
+// Sign : stamp the init message in data with the time and sign it again, as it has to be
+// once the cookie of a retry is put in
+func (c *Credential) Sign(data []byte) {
+	binary.BigEndian.PutUint64(data[InitTimeIndex:InitTimeIndex+8], uint64(time.Now().Unix()))
+	if c != nil {
+		copy(data[InitProofIndex:InitProofIndex+ProofLen], initProof(data, c.Token))
+	}
+}
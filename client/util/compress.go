@@ -0,0 +1,70 @@
+package util
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+)
+
+// Compressor : compresses the chunks of normal messages one by one, chunks arrive in any
+// order so none depends on another. The flate writer is reused, it is costly to create;
+// not safe for concurrent use
+type Compressor struct {
+	w   *flate.Writer
+	buf bytes.Buffer
+}
+
+func NewCompressor() *Compressor {
+	// only an invalid level fails
+	w, _ := flate.NewWriter(nil, flate.BestSpeed)
+	return &Compressor{w: w}
+}
+
+// Compress : the normal message in data with its chunk compressed, false and data itself
+// if that does not make it shorter; the head is copied, the caller sets the function code
+func (c *Compressor) Compress(data []byte) ([]byte, bool) {
+	c.buf.Reset()
+	c.buf.Write(data[:NormalHeadLen])
+	c.w.Reset(&c.buf)
+	_, err := c.w.Write(data[NormalHeadLen:])
+	if err == nil {
+		err = c.w.Close()
+	}
+	if err != nil || c.buf.Len() >= len(data) {
+		return data, false
+	}
+	return append([]byte(nil), c.buf.Bytes()...), true
+}
+
+// Decompressor : inflates compressed chunks, reusing one flate reader; not safe for concurrent use
+type Decompressor struct {
+	src bytes.Reader
+	r   io.ReadCloser
+}
+
+func NewDecompressor() *Decompressor {
+	d := &Decompressor{}
+	d.r = flate.NewReader(&d.src)
+	return d
+}
+
+// Decompress : the chunk of the compressed message in data, which must inflate to chunkLen bytes;
+// no more than that is ever inflated, whatever the message claims
+func (d *Decompressor) Decompress(data []byte, chunkLen int) ([]byte, error) {
+	d.src.Reset(data[NormalHeadLen:])
+	err := d.r.(flate.Resetter).Reset(&d.src, nil)
+	if err != nil {
+		return nil, err
+	}
+	chunk := make([]byte, chunkLen)
+	_, err = io.ReadFull(d.r, chunk)
+	if err != nil {
+		return nil, err
+	}
+	var extra [1]byte
+	if n, _ := io.ReadFull(d.r, extra[:]); n > 0 {
+		return nil, errors.New("chunk inflates beyond its length")
+	}
+	return chunk, nil
+}
@@ -0,0 +1,369 @@
+package util
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// nonceLen : length of the GCM nonce a sealed message carries after its head. It is random
+// under a handshake key; under a session key it is the role of the side that sealed the
+// message in the first byte and a counter of the messages that side sealed in the last 8
+const nonceLen = 12
+
+const (
+	sealedByClient = 1
+	sealedByServer = 2
+	// replayWindow : how far below the highest counter received a session still takes
+	// a message, once; the bits of sessionKey.seen
+	replayWindow = 64
+)
+
+// session : a sealed session is told apart by the peer address, the direction and the id
+type session struct {
+	addr string
+	flag uint8
+	id   uint64
+}
+
+type sessionKey struct {
+	aead       cipher.AEAD
+	clientSalt []byte
+	serverSalt []byte
+	// role of this side, the messages it seals count up from sent
+	role uint8
+	sent uint64
+	// highest counter received, and which of the replayWindow counters up to it arrived
+	received uint64
+	seen     uint64
+	used     time.Time
+}
+
+// peerKey : master key agreed with one peer by key exchange
+type peerKey struct {
+	master    []byte
+	handshake cipher.AEAD
+	used      time.Time
+}
+
+// Keyring : keys of AES-GCM sealed messages. Init and init ack are sealed with a handshake key
+// derived from a master key alone, each session with its own key derived from the master and the
+// random salts both sides put in init and init ack. The master is derived from the pre-shared key,
+// from the secret of a key exchange with the peer, or from both. The head of a message stays
+// readable but is authenticated; safe for concurrent use
+type Keyring struct {
+	// master derived from the pre-shared key, nil without one
+	master    []byte
+	handshake cipher.AEAD
+	// signs key exchanges on a server, nil if it does not take part in them
+	hostKey ed25519.PrivateKey
+	lock    sync.Mutex
+	// masters agreed by key exchange, by peer address
+	peers map[string]*peerKey
+	// salt of the init being sent, by direction flag, kept until it is acked
+	pending  map[uint8][]byte
+	sessions map[session]*sessionKey
+}
+
+// NewKeyring : a keyring with the master derived from psk, or with none if psk is empty,
+// then only peers a key was exchanged with are understood. psk is random, not a passphrase,
+// of at least PskLen bytes
+func NewKeyring(psk []byte) (*Keyring, error) {
+	k := &Keyring{
+		peers:    make(map[string]*peerKey),
+		pending:  make(map[uint8][]byte),
+		sessions: make(map[session]*sessionKey),
+	}
+	if len(psk) > 0 {
+		if len(psk) < PskLen {
+			return nil, errors.New("pre-shared key too short")
+		}
+		k.master = derive(extract([]byte("psk"), psk), []byte("master"))
+		handshake, err := newAEAD(derive(k.master, []byte("handshake")))
+		if err != nil {
+			return nil, err
+		}
+		k.handshake = handshake
+	}
+	return k, nil
+}
+
+// Seal : the message in data sealed for addr, with the key of its session if there is one,
+// nil if there is no key for addr at all. Init gets the salt of this side and init ack that
+// of the server, which starts the session; hello, hello ack and retry are not sealed
+func (k *Keyring) Seal(addr *net.UDPAddr, data []byte) []byte {
+	var aead cipher.AEAD
+	var nonce []byte
+	switch data[0] & 0x7f {
+	case Hello, HelloAck, Retry:
+		return data
+	case Init:
+		if len(data) >= InitHeadLen {
+			copy(data[InitSaltIndex:InitSaltIndex+SaltLen], k.clientSalt(data[0]&0x80))
+			caps := binary.BigEndian.Uint16(data[InitCapIndex : InitCapIndex+2])
+			binary.BigEndian.PutUint16(data[InitCapIndex:InitCapIndex+2], caps|CapEncrypt)
+		}
+	case InitAck:
+		if len(data) >= InitHeadLen {
+			k.accept(addr, data)
+		}
+	default:
+		if s := k.session(addr, data); s != nil {
+			aead, nonce = s.aead, k.count(s)
+		}
+	}
+	if aead == nil {
+		_, aead = k.peer(addr)
+	}
+	if aead == nil {
+		return nil
+	}
+	sealed := make([]byte, MessHeadLen+nonceLen, len(data)+SealOverhead)
+	copy(sealed, data[:MessHeadLen])
+	if nonce != nil {
+		copy(sealed[MessHeadLen:], nonce)
+	} else {
+		rand.Read(sealed[MessHeadLen:])
+	}
+	return aead.Seal(sealed, sealed[MessHeadLen:], data[MessHeadLen:], data[:MessHeadLen])
+}
+
+// Open : the message sealed in data by addr, false if it fails authentication.
+// An init ack received starts the session it acks. Hello, hello ack and retry are not sealed,
+// a hello ack proves itself by the signature it carries, a retry is only good for its address
+func (k *Keyring) Open(addr *net.UDPAddr, data []byte) ([]byte, bool) {
+	if len(data) >= MessHeadLen {
+		switch data[0] & 0x7f {
+		case Hello, HelloAck, Retry:
+			return data, true
+		}
+	}
+	if len(data) < MessHeadLen+SealOverhead {
+		return nil, false
+	}
+	if s := k.session(addr, data); s != nil {
+		if plain, ok := open(s.aead, data); ok {
+			return plain, k.fresh(s, data[MessHeadLen:MessHeadLen+nonceLen])
+		}
+	}
+	_, handshake := k.peer(addr)
+	if handshake == nil {
+		return nil, false
+	}
+	plain, ok := open(handshake, data)
+	if !ok {
+		return nil, false
+	}
+	if plain[0]&0x7f == InitAck && len(plain) >= InitHeadLen {
+		k.establish(addr, plain)
+	}
+	return plain, true
+}
+
+// AddPeer : seal what is exchanged with addr under a master derived from secret,
+// mixed with the pre-shared key if there is one
+func (k *Keyring) AddPeer(addr *net.UDPAddr, secret []byte) {
+	master := secret
+	if k.master != nil {
+		master = derive(k.master, secret)
+	}
+	// a 32 byte key is always a valid AES key
+	handshake, _ := newAEAD(derive(master, []byte("handshake")))
+	now := time.Now()
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	for other, p := range k.peers {
+		if now.Sub(p.used) > KeyIdleTime {
+			delete(k.peers, other)
+		}
+	}
+	k.peers[addr.String()] = &peerKey{
+		master:    master,
+		handshake: handshake,
+		used:      now,
+	}
+}
+
+// peer : master and handshake key for addr, those of the pre-shared key unless a key was
+// exchanged with addr
+func (k *Keyring) peer(addr *net.UDPAddr) ([]byte, cipher.AEAD) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return k.peerLocked(addr)
+}
+
+func (k *Keyring) peerLocked(addr *net.UDPAddr) ([]byte, cipher.AEAD) {
+	if p, ok := k.peers[addr.String()]; ok {
+		p.used = time.Now()
+		return p.master, p.handshake
+	}
+	return k.master, k.handshake
+}
+
+func (k *Keyring) clientSalt(flag uint8) []byte {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	salt, ok := k.pending[flag]
+	if !ok {
+		// the same salt for every try, whichever init the server acks
+		salt = make([]byte, SaltLen)
+		rand.Read(salt)
+		k.pending[flag] = salt
+	}
+	return salt
+}
+
+// accept : add the salt of the server to the init ack in data and start its session,
+// an init ack sent again for the same init keeps the key
+func (k *Keyring) accept(addr *net.UDPAddr, data []byte) {
+	name := sessionName(addr, data)
+	clientSalt := data[InitSaltIndex : InitSaltIndex+SaltLen]
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	s, ok := k.sessions[name]
+	if !ok || !bytes.Equal(s.clientSalt, clientSalt) {
+		master, _ := k.peerLocked(addr)
+		if master == nil {
+			return
+		}
+		serverSalt := make([]byte, SaltLen)
+		rand.Read(serverSalt)
+		s = k.add(name, master, clientSalt, serverSalt, sealedByServer)
+	}
+	copy(data[InitPeerSaltIndex:InitPeerSaltIndex+SaltLen], s.serverSalt)
+}
+
+// establish : start the session of the init ack in data received
+func (k *Keyring) establish(addr *net.UDPAddr, data []byte) {
+	name := sessionName(addr, data)
+	clientSalt := data[InitSaltIndex : InitSaltIndex+SaltLen]
+	serverSalt := data[InitPeerSaltIndex : InitPeerSaltIndex+SaltLen]
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if s, ok := k.sessions[name]; ok && bytes.Equal(s.clientSalt, clientSalt) && bytes.Equal(s.serverSalt, serverSalt) {
+		return
+	}
+	master, _ := k.peerLocked(addr)
+	k.add(name, master, clientSalt, serverSalt, sealedByClient)
+	// the next init gets a new salt
+	delete(k.pending, name.flag)
+}
+
+// add : the key of session name for the side of role, keys unused for KeyIdleTime are dropped
+// on the way
+func (k *Keyring) add(name session, master, clientSalt, serverSalt []byte, role uint8) *sessionKey {
+	now := time.Now()
+	for other, s := range k.sessions {
+		if now.Sub(s.used) > KeyIdleTime {
+			delete(k.sessions, other)
+		}
+	}
+	info := append([]byte("session"), clientSalt...)
+	// a 32 byte key is always a valid AES key
+	aead, _ := newAEAD(derive(master, append(info, serverSalt...)))
+	s := &sessionKey{
+		aead:       aead,
+		clientSalt: append([]byte(nil), clientSalt...),
+		serverSalt: append([]byte(nil), serverSalt...),
+		role:       role,
+		used:       now,
+	}
+	k.sessions[name] = s
+	return s
+}
+
+func (k *Keyring) session(addr *net.UDPAddr, data []byte) *sessionKey {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	s, ok := k.sessions[sessionName(addr, data)]
+	if !ok {
+		return nil
+	}
+	s.used = time.Now()
+	return s
+}
+
+// count : the nonce of the next message this side seals in session s
+func (k *Keyring) count(s *sessionKey) []byte {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	s.sent++
+	nonce := make([]byte, nonceLen)
+	nonce[0] = s.role
+	binary.BigEndian.PutUint64(nonce[nonceLen-8:], s.sent)
+	return nonce
+}
+
+// fresh : whether the message with nonce opened in session s was sealed by the other side and
+// did not arrive before, it is then marked as arrived. A counter replayWindow or more below
+// the highest one received is taken as a replay too
+func (k *Keyring) fresh(s *sessionKey, nonce []byte) bool {
+	counter := binary.BigEndian.Uint64(nonce[nonceLen-8:])
+	if nonce[0] == s.role || counter == 0 {
+		return false
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if counter > s.received {
+		s.seen = s.seen<<(counter-s.received) | 1
+		s.received = counter
+		return true
+	}
+	if s.received-counter >= replayWindow {
+		return false
+	}
+	bit := uint64(1) << (s.received - counter)
+	if s.seen&bit != 0 {
+		return false
+	}
+	s.seen |= bit
+	return true
+}
+
+func sessionName(addr *net.UDPAddr, data []byte) session {
+	return session{
+		addr: addr.String(),
+		flag: data[0] & 0x80,
+		id:   binary.BigEndian.Uint64(data[MessIdIndex : MessIdIndex+8]),
+	}
+}
+
+func open(aead cipher.AEAD, data []byte) ([]byte, bool) {
+	plain := make([]byte, MessHeadLen, len(data)-SealOverhead)
+	copy(plain, data[:MessHeadLen])
+	plain, err := aead.Open(plain, data[MessHeadLen:MessHeadLen+nonceLen], data[MessHeadLen+nonceLen:], data[:MessHeadLen])
+	return plain, err == nil
+}
+
+// extract : a 32 byte key with the entropy of secret, HMAC-SHA256 keyed with salt as in the
+// extract step of HKDF
+func extract(salt, secret []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(secret)
+	return mac.Sum(nil)
+}
+
+// derive : a 32 byte key for info from key, HMAC-SHA256 as in the expand step of HKDF
+func derive(key, info []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(info)
+	mac.Write([]byte{1})
+	return mac.Sum(nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
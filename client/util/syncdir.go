@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package util
+
+import "os"
+
+// syncDir : flush the directory entries of dir, a rename in it is durable afterwards
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
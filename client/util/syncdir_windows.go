@@ -0,0 +1,9 @@
+//go:build windows
+// +build windows
+
+package util
+
+// syncDir : a directory cannot be flushed here, NTFS journals the rename itself
+func syncDir(dir string) error {
+	return nil
+}
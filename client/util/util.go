@@ -1,7 +1,15 @@
 package util
 
 import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math"
+	"math/bits"
 	"net"
+	"os"
 	"time"
 )
 
@@ -15,27 +23,155 @@ type IMessage struct {
 type UploadFile struct {
 	Filename   string
 	Addr       *net.UDPAddr
-	TotalLen   uint16
-	CurrLen    uint16
-	Data       [][]byte
+	Size       int64
+	TotalLen   uint32
+	CurrLen    uint32
+	Corrupt    uint32
+	Digest     []byte
+	File       *os.File
+	Received   Bitmap
 	UpdateTime time.Time
 }
 
 type DownloadFile struct {
 	FileName     string
 	Addr         *net.UDPAddr
-	Data         [][]byte
+	Size         int64
+	Digest       []byte
+	File         *os.File
 	DownloadTime time.Time
 }
 
 const (
-	// MaxLen : maximum bytes in a transfer
+	// MaxLen : maximum bytes of a bitmap in one message
 	MaxLen = 1024
+	// MessIdIndex : index of the session id, 8 random bytes
+	MessIdIndex = 1
+	// MessLenIndex : index of message length or chunk index, 4 bytes
+	MessLenIndex = MessIdIndex + 8
 	// MessHeadLen : message head length
-	MessHeadLen = 5
-	// MessLenIndex : index of message length
-	MessLenIndex = 3
-	MessIdIndex  = 1
+	MessHeadLen = MessLenIndex + 4
+
+	// MessCrcIndex : index of the CRC32 in normal messages, 4 bytes
+	MessCrcIndex = MessHeadLen
+	// NormalHeadLen : normal message head length, the chunk data follows it
+	NormalHeadLen = MessCrcIndex + 4
+
+	// InitVersionIndex : index of protocol version in init and init ack messages
+	InitVersionIndex = MessHeadLen
+	// InitSizeIndex : index of file size in init and init ack messages, 8 bytes
+	InitSizeIndex = InitVersionIndex + 1
+	// InitDigestIndex : index of the whole file SHA-256 in init and init ack messages
+	InitDigestIndex = InitSizeIndex + 8
+	// InitFlagIndex : index of the init flags in init and init ack messages
+	InitFlagIndex = InitDigestIndex + DigestLen
+	// InitWindowIndex : index of the send window in init and init ack messages, 2 bytes
+	InitWindowIndex = InitFlagIndex + 1
+	// InitFecIndex : index of the FEC group size in init and init ack messages,
+	// a parity chunk follows every so many chunks, 0 for none
+	InitFecIndex = InitWindowIndex + 2
+	// InitChunkIndex : index of the chunk size in init and init ack messages, 2 bytes
+	InitChunkIndex = InitFecIndex + 1
+	// InitCapIndex : index of the capabilities in init and init ack messages, 2 bytes
+	InitCapIndex = InitChunkIndex + 2
+	// InitSaltIndex, InitPeerSaltIndex : index of the random salts of client and server
+	// in init and init ack messages a session key is derived from, zero unless sealed
+	InitSaltIndex     = InitCapIndex + 2
+	InitPeerSaltIndex = InitSaltIndex + SaltLen
+	// InitProofIndex : index of the HMAC proof of the user in init, 32 bytes
+	InitProofIndex = InitPeerSaltIndex + SaltLen
+	// InitCookieIndex : index of the cookie of a retry echoed in init
+	InitCookieIndex = InitProofIndex + ProofLen
+	// InitTimeIndex : index of the unix time init was sent at, 8 bytes
+	InitTimeIndex = InitCookieIndex + CookieLen
+	// InitUserLenIndex : index of the length of the user name in init
+	InitUserLenIndex = InitTimeIndex + 8
+	// InitHeadLen : init message head length, the user name and the file name follow it
+	InitHeadLen = InitUserLenIndex + 1
+
+	// HelloKeyIndex : index of the ephemeral X25519 key in hello and hello ack
+	HelloKeyIndex = MessHeadLen
+	HelloKeyLen   = 32
+	// HelloHostIndex : index of the ed25519 host key of the server in hello ack
+	HelloHostIndex = HelloKeyIndex + HelloKeyLen
+	// HelloCookieIndex : index of the cookie of a retry echoed in hello
+	HelloCookieIndex = HelloHostIndex
+	// HelloSigIndex : index of the host key signature in hello ack
+	HelloSigIndex = HelloHostIndex + ed25519.PublicKeySize
+	// HelloLen : length of hello ack, and of hello padded to it
+	HelloLen = HelloSigIndex + ed25519.SignatureSize
+	// RetryCookieIndex : index of the cookie in a retry
+	RetryCookieIndex = MessHeadLen
+	// RetryLen : length of a retry
+	RetryLen = RetryCookieIndex + CookieLen
+	// BusyWaitIndex : index of the milliseconds to wait before trying again in busy, 4 bytes
+	BusyWaitIndex = MessHeadLen
+	// BusyLen : length of busy
+	BusyLen = BusyWaitIndex + 4
+
+	// InitResume : in init, continue an interrupted upload of the same content if there is one;
+	// in init ack, chunks of an earlier upload were kept
+	InitResume = 0x1
+
+	// DigestLen : length of the whole file digest
+	DigestLen = sha256.Size
+
+	// ProtoVersion : wire format version, 1 means 32-bit chunk indices and 64-bit file size,
+	// 2 adds a CRC32 to normal messages, 3 adds the whole file SHA-256 to init messages,
+	// 4 adds init flags and resumable uploads, 5 adds the negotiated send window,
+	// 6 replaces the ack of every chunk by SACK and NACK bitmaps, 7 adds parity chunks,
+	// 8 adds the negotiated chunk size and path MTU probes, 9 adds capabilities,
+	// 10 adds the salts of sealed sessions, 11 adds the user and its proof,
+	// 12 adds the cookie of a retry, 13 widens the session id to 8 random bytes,
+	// 14 adds the time to wait to busy, 15 acks the stored upload with UploadCommitted,
+	// 16 echoes the cookie of a retry in hello, 17 signs the cookie into the proof of the user,
+	// 18 counts the sealed messages of a session in their nonce, 19 refuses a chunk size
+	// with BadChunkSize
+	ProtoVersion = 19
+
+	// ProofLen : length of the proof of the user in init
+	ProofLen = sha256.Size
+	// MaxUserLen : longest user name
+	MaxUserLen = 255
+	// AuthSkew : how far the time an init was sent at may be off
+	AuthSkew = time.Minute * 5
+
+	// SaltLen : length of the salts in init and init ack
+	SaltLen = 16
+	// PskLen : least length of the random pre-shared key
+	PskLen = 32
+	// SealOverhead : bytes a sealed message is longer, the GCM nonce and tag
+	SealOverhead = 12 + 16
+	// KeyIdleTime : how long the key of a sealed session is kept unused
+	KeyIdleTime = time.Minute * 10
+
+	// CookieLen : length of the cookie of a retry, the time it was made and its MAC
+	CookieLen = 8 + 16
+	// CookieTime : how long a cookie is good for
+	CookieTime = time.Minute
+
+	// DefaultWindow : chunks in flight when nothing else is configured
+	DefaultWindow = 64
+	// MaxWindow : most chunks in flight, init has 16 bits for the window
+	MaxWindow = 1<<16 - 1
+	// MaxFec : largest FEC group, init has 8 bits for it
+	MaxFec = 1<<8 - 1
+	// InitialRTO : retransmission timeout before the first round trip was measured
+	InitialRTO = time.Second
+	// MinRTO, MaxRTO : bounds of the retransmission timeout derived from the round trip time
+	MinRTO = time.Millisecond * 30
+	MaxRTO = time.Second * 10
+	// DupThresh : a chunk is taken as lost once chunks sent so many sends after it were acked
+	DupThresh = 3
+	// InitialCwnd : congestion window a transfer starts with, grown by acks up to the send window
+	InitialCwnd = 4
+	// WindowTick : how often a sender looks for chunks to send again, and a receiver
+	// acks what arrived since its last SACK
+	WindowTick = time.Millisecond * 10
+	// SackChunks : a receiver sends a SACK at the latest after so many new chunks
+	SackChunks = 32
+	// MaxParity : parities a receiver keeps at most for groups lacking more than one chunk
+	MaxParity = 4096
 
 	CleanTime    = time.Minute * 2
 	NoUpdateTime = time.Minute * 2
@@ -46,8 +182,35 @@ const (
 	MaxStorageTry  = 100
 	MaxUploadTry   = 10
 	MaxDownloadTry = 10
+	// CommitRetry, CommitTimeout : once all chunks are acked, ask every CommitRetry how the upload
+	// ended, it fails if the server does not answer for CommitTimeout
+	CommitRetry   = time.Second
+	CommitTimeout = time.Minute
+	// MaxBusyWait : longest a busy server is waited for before trying again
+	MaxBusyWait = time.Minute
+
+	// StateSaveChunks : save the resume state of a download every so many new chunks
+	StateSaveChunks = 1024
+	// PartSuffix : suffix of a file still being downloaded
+	PartSuffix = ".part"
+	// StateSuffix : suffix of the resume state next to a part file
+	StateSuffix = ".state"
+	// TmpSuffix : suffix of the file a state is written to before it replaces the old one
+	TmpSuffix = ".tmp"
 
-	OnceDownloadSize = 1024
+	// DefaultChunkSize : bytes of file data in a chunk when nothing else is negotiated
+	DefaultChunkSize = 1024
+	// MinChunkSize, MaxChunkSize : bounds of the chunk size, MaxChunkSize fits a jumbo frame
+	MinChunkSize = 256
+	MaxChunkSize = 8192
+	// MaxDatagram : largest message there is, a sealed normal message of the largest chunk
+	MaxDatagram = NormalHeadLen + MaxChunkSize + SealOverhead
+	// HelloTry, HelloTimeout : the key exchange fails if none of HelloTry hellos is answered in time
+	HelloTry     = 5
+	HelloTimeout = time.Second
+	// ProbeTry, ProbeTimeout : a probe size is too large if none of ProbeTry probes is answered in time
+	ProbeTry     = 2
+	ProbeTimeout = time.Millisecond * 300
 
 	UploadFlag   = 0x0
 	DownloadFlag = 0x80
@@ -67,10 +230,216 @@ const (
 	Init = iota
 	InitAck
 	Normal
+	// NormalAck : unused since version 6, chunks are acked by Sack
 	NormalAck
 	UploadFail
 	Busy
 	FileExist
 	FileNoExist
+	// DownloadSomeone : unused since version 6, chunks are requested by Nack
 	DownloadSomeone
+	VersionMismatch
+	DigestMismatch
+	ResumeQuery
+	ResumeState
+	// Sack : chunks below the index and those set in the bitmap from it on were received
+	Sack
+	// Nack : send the chunks set in the bitmap from the index on
+	Nack
+	// Parity : XOR of the chunks of the group at the index, laid out like a normal message
+	Parity
+	// Probe : padded to the datagram size in the index, to find the largest that gets through
+	Probe
+	// ProbeAck : the probe of the size in the index arrived whole
+	ProbeAck
+	// CapabilityMismatch : the peer lacks a capability this side requires
+	CapabilityMismatch
+	// Compressed : a normal message whose chunk is flate compressed, only with CapCompress
+	Compressed
+	// Hello : an ephemeral X25519 key of the client, starting a key exchange before init
+	Hello
+	// HelloAck : an ephemeral X25519 key of the server and its host key signing both
+	HelloAck
+	// AuthFail : the user of init is unknown or its proof is wrong
+	AuthFail
+	// PermissionDenied : the user may not upload or download the file of init
+	PermissionDenied
+	// BadFileName : the file name of init is absolute, leaves the storage path or is not valid
+	BadFileName
+	// Retry : init or hello again with the cookie in it, the server sends nothing more to an
+	// address before it proved to receive there; not sealed, like hello
+	Retry
+	// QuotaExceeded : the file is too large, the user has no quota left for it or the disk is full
+	QuotaExceeded
+	// UploadCommitted : the upload was verified and durably stored, also how a client asks
+	// for the end of an upload whose chunks all arrived
+	UploadCommitted
+	// UploadCommitFailed : the chunks of the upload all arrived, but storing the file failed
+	UploadCommitFailed
+	// BadChunkSize : the chunk size of init is too small, or makes more chunks of the file
+	// than an index counts
+	BadChunkSize
+)
+
+// capabilities, init offers those the client speaks and init ack holds those both sides speak
+const (
+	// CapChecksum : normal messages carry a CRC32
+	CapChecksum = 1 << iota
+	// CapCompress : chunk data may be compressed
+	CapCompress
+	// CapEncrypt : messages are sealed with AES-GCM, keyed from a pre-shared key
+	CapEncrypt
+	// CapWideIndex : chunk indices of 64 bits, not spoken yet
+	CapWideIndex
+
+	// Capabilities : all this side speaks
+	Capabilities = CapChecksum | CapCompress | CapEncrypt
+	// RequiredCaps : a peer lacking one of them is rejected
+	RequiredCaps = CapChecksum
 )
+
+// BusyWait : how long the server in the busy message in data asks to wait, false if it does not
+// say or wants more than MaxBusyWait
+func BusyWait(data []byte) (time.Duration, bool) {
+	if len(data) != BusyLen {
+		return 0, false
+	}
+	wait := time.Duration(binary.BigEndian.Uint32(data[BusyWaitIndex:BusyLen])) * time.Millisecond
+	return wait, wait <= MaxBusyWait
+}
+
+// CheckInitAck : whether the init ack in data speaks this version and no more than this side
+// does along with what it requires, else the function code to reject it with
+func CheckInitAck(data []byte) (uint8, bool) {
+	// an older server echoes the whole init message back
+	if len(data) != InitHeadLen || data[InitVersionIndex] != ProtoVersion {
+		return VersionMismatch, false
+	}
+	caps := binary.BigEndian.Uint16(data[InitCapIndex : InitCapIndex+2])
+	if caps&^Capabilities != 0 || caps&RequiredCaps != RequiredCaps {
+		return CapabilityMismatch, false
+	}
+	return 0, true
+}
+
+// ChunkCount : number of chunks of chunkSize bytes a file of size bytes is split into,
+// false if the file needs more chunks than a 32-bit index can address
+func ChunkCount(size int64, chunkSize int) (uint32, bool) {
+	if size < 0 || chunkSize <= 0 {
+		return 0, false
+	}
+	cnt := (size-1)/int64(chunkSize) + 1
+	if cnt > math.MaxUint32 {
+		return 0, false
+	}
+	return uint32(cnt), true
+}
+
+// ChunkLen : length of the chunk at index for a file of size bytes
+func ChunkLen(size int64, chunkSize int, index uint32) int {
+	begin := int64(index) * int64(chunkSize)
+	end := begin + int64(chunkSize)
+	if end > size {
+		end = size
+	}
+	if end < begin {
+		return 0
+	}
+	return int(end - begin)
+}
+
+// ReadChunk : read the chunk at index into a new normal message, the head is left for the caller
+// except the chunk index
+func ReadChunk(r io.ReaderAt, size int64, chunkSize int, index uint32) ([]byte, error) {
+	data := make([]byte, NormalHeadLen+ChunkLen(size, chunkSize, index))
+	n, err := r.ReadAt(data[NormalHeadLen:], int64(index)*int64(chunkSize))
+	if err == io.EOF && n == len(data)-NormalHeadLen {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(data[MessLenIndex:MessLenIndex+4], index)
+	return data, nil
+}
+
+// PutChecksum : fill in the CRC32 of a normal message, call it once the head is complete
+func PutChecksum(data []byte) {
+	binary.BigEndian.PutUint32(data[MessCrcIndex:MessCrcIndex+4], checksum(data))
+}
+
+// ChunkValid : whether a normal message arrived intact
+func ChunkValid(data []byte) bool {
+	if len(data) < NormalHeadLen {
+		return false
+	}
+	return binary.BigEndian.Uint32(data[MessCrcIndex:MessCrcIndex+4]) == checksum(data)
+}
+
+// checksum covers the head, so a damaged id or index is caught as well as damaged data
+func checksum(data []byte) uint32 {
+	crc := crc32.ChecksumIEEE(data[:MessCrcIndex])
+	return crc32.Update(crc, crc32.IEEETable, data[NormalHeadLen:])
+}
+
+// FileDigest : SHA-256 of everything r yields, read in a streaming way
+func FileDigest(r io.Reader) ([]byte, error) {
+	h := sha256.New()
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// Bitmap : one bit per chunk
+type Bitmap []byte
+
+func NewBitmap(n uint32) Bitmap {
+	return make(Bitmap, (uint64(n)+7)/8)
+}
+
+func (b Bitmap) Has(index uint32) bool {
+	return b[index/8]&(1<<(index%8)) != 0
+}
+
+func (b Bitmap) Set(index uint32) {
+	b[index/8] |= 1 << (index % 8)
+}
+
+func (b Bitmap) Clear(index uint32) {
+	b[index/8] &^= 1 << (index % 8)
+}
+
+// FirstClear : the first chunk not set, all below index are known to be set; len(b)*8 if there is none
+func (b Bitmap) FirstClear(index uint32) uint32 {
+	for i := index / 8; i < uint32(len(b)); i++ {
+		if b[i] != 0xff {
+			return i*8 + uint32(bits.TrailingZeros8(^b[i]))
+		}
+	}
+	return uint32(len(b)) * 8
+}
+
+// SackMessage : a SACK of the chunks in b, base is a chunk below which all are set.
+// All chunks below the returned index are set, the bitmap from it on follows the head;
+// the head is left for the caller except the index
+func SackMessage(b Bitmap, base uint32) []byte {
+	begin := base / 8
+	end := begin + MaxLen
+	if end > uint32(len(b)) {
+		end = uint32(len(b))
+	}
+	data := make([]byte, MessHeadLen, MessHeadLen+end-begin)
+	binary.BigEndian.PutUint32(data[MessLenIndex:MessLenIndex+4], begin*8)
+	return append(data, b[begin:end]...)
+}
+
+// Count : number of chunks set
+func (b Bitmap) Count() uint32 {
+	var cnt uint32
+	for _, v := range b {
+		cnt += uint32(bits.OnesCount8(v))
+	}
+	return cnt
+}
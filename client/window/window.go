@@ -0,0 +1,280 @@
+package window
+
+import (
+	"client/util"
+	"time"
+)
+
+type sent struct {
+	index uint32
+	at    time.Time
+	seq   uint64
+}
+
+// Sender : sliding window over the chunks of one transfer. At most size chunks
+// are in flight, fewer while the congestion window is smaller, and a chunk not
+// acked within the retransmission timeout is sent again
+type Sender struct {
+	total  uint32
+	size   int
+	acked  util.Bitmap
+	remain uint32
+	next   uint32
+	// chunks below it are known to be acked
+	low uint32
+	// chunks sent and neither acked nor taken as lost, new sends and resends count alike
+	inflight int
+	// chunks in the order they were sent, acked ones are skipped when they reach the front
+	queue []sent
+	// chunks taken as lost, waiting for room in the window to be sent again
+	lost   []uint32
+	isLost map[uint32]struct{}
+	// first send time of chunks sent once, only those give RTT samples (Karn)
+	first map[uint32]time.Time
+	// every send gets the next seq, last holds the seq of the latest send of a chunk in flight
+	// and highest the highest seq acked so far
+	seq     uint64
+	last    map[uint32]uint64
+	highest uint64
+
+	// RFC 6298 round trip estimation
+	srtt   time.Duration
+	rttvar time.Duration
+	rto    time.Duration
+	// congestion window in chunks, slow start below ssthresh, additive increase above
+	cwnd     float64
+	ssthresh float64
+	// chunks sent before it do not shrink the window again
+	recover time.Time
+}
+
+// NewSender : acked holds chunks the peer already has, nil for none
+func NewSender(total uint32, size int, acked util.Bitmap) *Sender {
+	if acked == nil {
+		acked = util.NewBitmap(total)
+	}
+	if size < 1 {
+		size = 1
+	}
+	return &Sender{
+		total:    total,
+		size:     size,
+		acked:    acked,
+		remain:   total - acked.Count(),
+		first:    make(map[uint32]time.Time),
+		last:     make(map[uint32]uint64),
+		isLost:   make(map[uint32]struct{}),
+		rto:      util.InitialRTO,
+		cwnd:     util.InitialCwnd,
+		ssthresh: float64(size),
+	}
+}
+
+// Ack : mark index delivered at now, false if it already was
+func (s *Sender) Ack(index uint32, now time.Time) bool {
+	at, ok := s.ack(index)
+	if !ok {
+		return false
+	}
+	if !at.IsZero() {
+		s.sample(now.Sub(at))
+	}
+	return true
+}
+
+// Sack : apply a selective ack, all chunks below base and those set in acked from base on
+// were delivered at now; the number of chunks newly acked
+func (s *Sender) Sack(base uint32, acked util.Bitmap, now time.Time) uint32 {
+	var cnt uint32
+	// the latest first send among the newly acked gives the RTT sample least delayed by the receiver
+	var latest time.Time
+	mark := func(index uint32) {
+		at, ok := s.ack(index)
+		if !ok {
+			return
+		}
+		cnt++
+		if at.After(latest) {
+			latest = at
+		}
+	}
+	if base > s.total {
+		base = s.total
+	}
+	for ; s.low < base; s.low++ {
+		mark(s.low)
+	}
+	for i := uint32(0); i < uint32(len(acked))*8 && uint64(base)+uint64(i) < uint64(s.total); i++ {
+		if acked.Has(i) {
+			mark(base + i)
+		}
+	}
+	if !latest.IsZero() {
+		s.sample(now.Sub(latest))
+	}
+	return cnt
+}
+
+// ack : mark index delivered and grow the congestion window, the first send time
+// if it gives an RTT sample
+func (s *Sender) ack(index uint32) (time.Time, bool) {
+	if index >= s.total || s.acked.Has(index) {
+		return time.Time{}, false
+	}
+	s.acked.Set(index)
+	s.remain--
+	if _, ok := s.isLost[index]; ok {
+		// it left the window when it was taken as lost
+		delete(s.isLost, index)
+	} else if s.inflight > 0 {
+		s.inflight--
+	}
+	if seq, ok := s.last[index]; ok {
+		delete(s.last, index)
+		if seq > s.highest {
+			s.highest = seq
+		}
+	}
+	at, ok := s.first[index]
+	if ok {
+		delete(s.first, index)
+	}
+	if s.cwnd < s.ssthresh {
+		s.cwnd++
+	} else {
+		s.cwnd += 1 / s.cwnd
+	}
+	if s.cwnd > float64(s.size) {
+		s.cwnd = float64(s.size)
+	}
+	return at, true
+}
+
+// sample : update the RTT estimate and the timeout derived from it
+func (s *Sender) sample(rtt time.Duration) {
+	if s.srtt == 0 {
+		s.srtt = rtt
+		s.rttvar = rtt / 2
+	} else {
+		diff := s.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		s.rttvar = (3*s.rttvar + diff) / 4
+		s.srtt = (7*s.srtt + rtt) / 8
+	}
+	variance := 4 * s.rttvar
+	if variance < util.WindowTick {
+		variance = util.WindowTick
+	}
+	s.rto = clamp(s.srtt + variance)
+}
+
+// loss : a chunk sent at at was lost, halve the window once per round trip; if it timed out,
+// start over from one chunk in slow start (RFC 5681) and back off the retransmission timeout
+func (s *Sender) loss(at, now time.Time, timeout bool) {
+	if at.Before(s.recover) {
+		return
+	}
+	s.recover = now
+	s.ssthresh = s.cwnd / 2
+	if s.ssthresh < 2 {
+		s.ssthresh = 2
+	}
+	s.cwnd = s.ssthresh
+	if timeout {
+		s.cwnd = 1
+		s.rto = clamp(s.rto * 2)
+	}
+}
+
+func clamp(rto time.Duration) time.Duration {
+	if rto < util.MinRTO {
+		return util.MinRTO
+	}
+	if rto > util.MaxRTO {
+		return util.MaxRTO
+	}
+	return rto
+}
+
+// Next : the chunk to send now while the window has room, a lost one first, then a new one.
+// A chunk is lost if chunks sent util.DupThresh sends after it were acked, or if it timed out,
+// which takes every chunk in flight as lost
+func (s *Sender) Next(now time.Time) (uint32, bool) {
+	for len(s.queue) > 0 {
+		front := s.queue[0]
+		if s.acked.Has(front.index) {
+			s.queue = s.queue[1:]
+			continue
+		}
+		timeout := now.Sub(front.at) >= s.rto
+		if !timeout && front.seq+util.DupThresh > s.highest {
+			break
+		}
+		// gone from the path, it leaves room for what is sent in its place
+		s.loss(front.at, now, timeout)
+		s.queue = s.queue[1:]
+		s.lose(front.index)
+		if timeout {
+			// nothing came back for a whole timeout, what was sent after it is taken as gone too
+			// and sent again as the window grows from one chunk
+			for _, rest := range s.queue {
+				if !s.acked.Has(rest.index) {
+					s.lose(rest.index)
+				}
+			}
+			s.queue = s.queue[:0]
+		}
+	}
+	if s.inflight >= int(s.cwnd) {
+		return 0, false
+	}
+	for len(s.lost) > 0 {
+		index := s.lost[0]
+		s.lost = s.lost[1:]
+		if _, ok := s.isLost[index]; !ok {
+			// acked late, after all
+			continue
+		}
+		delete(s.isLost, index)
+		s.inflight++
+		s.queue = append(s.queue, s.send(index, now))
+		return index, true
+	}
+	for s.next < s.total && s.acked.Has(s.next) {
+		s.next++
+	}
+	if s.next >= s.total {
+		return 0, false
+	}
+	index := s.next
+	s.next++
+	s.inflight++
+	s.queue = append(s.queue, s.send(index, now))
+	s.first[index] = now
+	return index, true
+}
+
+// lose : index left the window, it waits to be sent again
+func (s *Sender) lose(index uint32) {
+	delete(s.first, index)
+	s.lost = append(s.lost, index)
+	s.isLost[index] = struct{}{}
+	s.inflight--
+}
+
+func (s *Sender) send(index uint32, now time.Time) sent {
+	s.seq++
+	s.last[index] = s.seq
+	return sent{index: index, at: now, seq: s.seq}
+}
+
+// Remain : chunks not acked yet
+func (s *Sender) Remain() uint32 {
+	return s.remain
+}
+
+func (s *Sender) Done() bool {
+	return s.remain == 0
+}
@@ -1,16 +1,53 @@
 package main
 
-import "flag"
+import (
+	"flag"
+	"server/util"
+)
 
 type Cmd struct {
 	Port        string
 	StoragePath string
+	MemStore    int64
+	Window      uint
+	Chunk       uint
+	Psk         string
+	HostKey     string
+	Users       string
+	AddUser     string
+	Acl         string
+	IPPackets   float64
+	IPBytes     float64
+	IPSessions  float64
+	Sessions    int
+	Memory      int64
+	MaxSize     int64
+	Quota       int64
+	MinFree     int64
+	Usage       string
 }
 
 func NewCmd() *Cmd {
 	cmd := &Cmd{}
 	flag.StringVar(&cmd.Port, "port", "9091", "-port 9090")
 	flag.StringVar(&cmd.StoragePath, "sp", ".", "-sp D:\\")
+	flag.Int64Var(&cmd.MemStore, "memstore", 0, "-memstore 1073741824, keep up to so many bytes of files in memory instead of -sp, they are lost on exit")
+	flag.UintVar(&cmd.Window, "window", util.DefaultWindow, "-window 64")
+	flag.UintVar(&cmd.Chunk, "chunk", util.MaxChunkSize, "-chunk 1024, largest chunk size a client may ask for")
+	flag.StringVar(&cmd.Psk, "psk", "", "-psk psk.key, seal all messages with a key derived from the random key in this file, created if missing")
+	flag.StringVar(&cmd.HostKey, "hostkey", "", "-hostkey host.key, answer key exchanges signed with the key in it, created if missing")
+	flag.StringVar(&cmd.Users, "users", "", "-users users.txt, only users in this credentials file may transfer files")
+	flag.StringVar(&cmd.AddUser, "adduser", "", "-adduser alice, add alice with the password read from stdin to the -users file and exit")
+	flag.StringVar(&cmd.Acl, "acl", "", "-acl acl.txt, who may read or write which files, everyone may do anything without it")
+	flag.Float64Var(&cmd.IPPackets, "ippps", 20000, "-ippps 20000, packets a second taken from one ip, 0 for no limit")
+	flag.Float64Var(&cmd.IPBytes, "ipbps", 64<<20, "-ipbps 67108864, bytes a second taken from one ip, 0 for no limit")
+	flag.Float64Var(&cmd.IPSessions, "ipsessions", 60, "-ipsessions 60, new sessions a minute one ip may start, 0 for no limit")
+	flag.IntVar(&cmd.Sessions, "sessions", 1024, "-sessions 1024, sessions at the same time, 0 for no limit")
+	flag.Int64Var(&cmd.Memory, "memory", 1<<30, "-memory 1073741824, bytes all sessions may reserve for their state, 0 for no limit")
+	flag.Int64Var(&cmd.MaxSize, "maxsize", 0, "-maxsize 1073741824, largest file that may be uploaded, 0 for no limit")
+	flag.Int64Var(&cmd.Quota, "quota", 0, "-quota 10737418240, bytes each user may store, 0 for no limit, needs -usage")
+	flag.Int64Var(&cmd.MinFree, "minfree", 64<<20, "-minfree 67108864, bytes kept free in the storage, 0 for no limit")
+	flag.StringVar(&cmd.Usage, "usage", "", "-usage usage.txt, who stored which file, to count the quota of each user")
 	flag.Parse()
 	return cmd
 }
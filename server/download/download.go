@@ -3,21 +3,25 @@ package download
 import (
 	"context"
 	"encoding/binary"
+	"io"
 	"log"
-	"math"
-	"math/rand"
 	"net"
 	"os"
 	"server/util"
-	"strings"
+	"server/window"
 	"sync"
 	"time"
 )
 
-func Download(storagePath string, recv, send chan util.IMessage, ctx context.Context) {
-	dataMap := make(map[uint16]util.DownloadFile, 256)
+func Download(store util.Storage, downloadWindow uint16, maxChunk int, acl *util.ACL, limiter *util.Limiter,
+	recv, send chan util.IMessage, ctx context.Context) {
+	dataMap := make(map[uint64]util.DownloadFile, 256)
 	var mapLock sync.RWMutex
-	go cleanData(dataMap, send, mapLock, ctx)
+	// digests of served files, computed aside, a large file would hold up every session
+	digests := newDigestCache()
+	go cleanData(dataMap, limiter, send, &mapLock, ctx)
+	// for the chunks clients ask for, sendFile has its own
+	compressor := util.NewCompressor()
 	for {
 		select {
 		case <-ctx.Done():
@@ -27,8 +31,38 @@ func Download(storagePath string, recv, send chan util.IMessage, ctx context.Con
 			funcCode := data[0] & 0x7f
 			switch funcCode {
 			case util.Init:
-				fileName := string(data[util.MessHeadLen:])
-				exist := fileExists(storagePath, fileName)
+				fileName, ok := util.CleanName(util.InitFileName(data))
+				if !ok {
+					log.Printf("bad file name %q from %s", util.InitFileName(data), mess.Addr.String())
+					data[0] = util.DownloadFlag | util.BadFileName
+					mess.Data = data[:util.MessHeadLen]
+					send <- mess
+					continue
+				}
+				if !acl.Allowed(mess.User, fileName, util.PermRead) {
+					// checked first, whether the file exists is none of the business of the user
+					log.Printf("user %q may not read %s", mess.User, fileName)
+					data[0] = util.DownloadFlag | util.PermissionDenied
+					mess.Data = data[:util.MessHeadLen]
+					send <- mess
+					continue
+				}
+				if util.Outside(store, fileName) {
+					log.Printf("%s leads out of the storage path", fileName)
+					data[0] = util.DownloadFlag | util.BadFileName
+					mess.Data = data[:util.MessHeadLen]
+					send <- mess
+					continue
+				}
+				if id, ok := findSession(dataMap, &mapLock, mess.Addr, mess.User, fileName); ok {
+					// the init ack was lost, answer again without sending the file twice
+					mapLock.RLock()
+					mess.Data = initAck(data, id, dataMap[id], downloadWindow)
+					mapLock.RUnlock()
+					send <- mess
+					continue
+				}
+				exist := util.Exists(store, fileName)
 				if !exist {
 					// file no exists
 					data[0] = util.FileNoExist | util.DownloadFlag
@@ -36,86 +70,266 @@ func Download(storagePath string, recv, send chan util.IMessage, ctx context.Con
 					send <- mess
 					continue
 				}
-				storagePath = strings.TrimRight(storagePath, string(os.PathSeparator))
-				absPath := storagePath + string(os.PathSeparator) + fileName
-				file, err := os.Open(absPath)
+				file, err := store.Open(fileName, false)
 				if err != nil {
-					log.Printf("open file %s error：%s", absPath, err.Error())
+					log.Printf("open file %s error：%s", fileName, err.Error())
+					data[0] = util.DownloadFlag | util.UploadFail
+					mess.Data = data[:util.MessHeadLen]
+					send <- mess
 					continue
 				}
 				fileStat, err := file.Stat()
 				if err != nil {
+					log.Printf("stat file %s error：%s", fileName, err.Error())
+					file.Close()
+					data[0] = util.DownloadFlag | util.UploadFail
+					mess.Data = data[:util.MessHeadLen]
+					send <- mess
 					continue
 				}
-				fileData := make([]byte, fileStat.Size())
-				n, err := file.Read(fileData)
-				if err != nil {
-					log.Println(err)
+				size := fileStat.Size()
+				chunkSize := util.InitChunkSize(data, maxChunk)
+				totalLen, ok := util.ChunkCount(size, chunkSize)
+				if !ok || chunkSize < util.MinChunkSize {
+					log.Printf("client %s asks for %s in chunks of %d bytes", mess.Addr.String(), fileName, chunkSize)
+					file.Close()
+					data[0] = util.DownloadFlag | util.BadChunkSize
+					mess.Data = data[:util.MessHeadLen]
+					send <- mess
 					continue
 				}
-				err = file.Close()
-				if err != nil {
-					log.Println(err)
-				}
-				id, ok := generateId(dataMap, mapLock)
+				digest, ok := digests.get(store, fileName, fileStat)
 				if !ok {
+					// the client asks again once the digest is likely done
+					file.Close()
+					mess.Data = util.BusyMessage(data, digestWait(size))
+					send <- mess
 					continue
 				}
-				size := len(fileData[:n])
-				totalLen := uint16((size-1)/util.OnceDownloadSize) + 1
-				binary.BigEndian.PutUint16(data[util.MessLenIndex:util.MessLenIndex+2], totalLen)
-				binary.BigEndian.PutUint16(data[util.MessIdIndex:util.MessIdIndex+2], id)
-				data[0] = util.InitAck | util.DownloadFlag
-				mess.Data = data
-				// init ack
-				send <- mess
-				// Process file data
-				dataSlice := make([][]byte, totalLen)
-				for i, _ := range dataSlice {
-					begin := i * util.OnceDownloadSize
-					end := i*util.OnceDownloadSize + util.OnceDownloadSize
-					if end > len(fileData) {
-						end = len(fileData)
-					}
-					dataSlice[i] = append(dataSlice[i], fileData[begin:end]...)
+				reserved := util.SessionMemory(totalLen, chunkSize, downloadWindow, 0)
+				if wait, ok := limiter.Reserve(reserved); !ok {
+					file.Close()
+					mess.Data = util.BusyMessage(data, wait)
+					send <- mess
+					continue
+				}
+				id, ok := generateId(dataMap, &mapLock)
+				if !ok {
+					file.Close()
+					limiter.Release(reserved)
+					mess.Data = util.BusyMessage(data, util.BusyWait)
+					send <- mess
+					continue
 				}
 				downloadFile := util.DownloadFile{
 					FileName:     fileName,
+					User:         mess.User,
 					Addr:         mess.Addr,
-					Data:         dataSlice,
+					Size:         size,
+					ChunkSize:    chunkSize,
+					Caps:         binary.BigEndian.Uint16(data[util.InitCapIndex : util.InitCapIndex+2]),
+					Digest:       digest,
+					File:         file,
 					DownloadTime: time.Now(),
+					Reserved:     reserved,
+					Done:         make(chan struct{}),
 				}
+				// send file after initialization, a resuming client asks for the chunks it lacks itself
+				push := data[util.InitFlagIndex]&util.InitResume == 0
+				if push {
+					downloadFile.Acks = make(chan []byte, util.DownloadChanCnt)
+				}
+				mess.Data = initAck(data, id, downloadFile, downloadWindow)
+				// initAck left the smaller of both windows in data
+				inflight := int(binary.BigEndian.Uint16(data[util.InitWindowIndex : util.InitWindowIndex+2]))
+				// init ack
+				send <- mess
 				mapLock.Lock()
 				dataMap[id] = downloadFile
 				mapLock.Unlock()
-				// send file after initialization
-				var head []byte
-				head = append(head, util.DownloadFlag|util.Normal)
-				idBytes := make([]byte, 2, 2)
-				binary.BigEndian.PutUint16(idBytes, id)
-				head = append(head, idBytes...)
-				go sendFile(mess.Addr, head, dataSlice, send)
-			case util.DownloadSomeone:
+				if push {
+					finish := func() {
+						mapLock.Lock()
+						endSession(dataMap, id, limiter)
+						mapLock.Unlock()
+					}
+					go sendFile(id, downloadFile, inflight, data[util.InitFecIndex], finish, send)
+				}
+			case util.Nack:
+				// the client asks for every chunk set in the bitmap from the index on
+				mapLock.RLock()
+				messId := binary.BigEndian.Uint64(data[util.MessIdIndex : util.MessIdIndex+8])
+				fileData, exist := dataMap[messId]
+				mapLock.RUnlock()
+				if !exist || fileData.Addr.String() != mess.Addr.String() {
+					// a session is only good from the address that started it
+					continue
+				}
+				base := binary.BigEndian.Uint32(data[util.MessLenIndex : util.MessLenIndex+4])
+				missing := util.Bitmap(data[util.MessHeadLen:])
+				totalLen := fileData.TotalLen()
+				for i := uint32(0); i < uint32(len(missing))*8 && uint64(base)+uint64(i) < uint64(totalLen); i++ {
+					if !missing.Has(i) {
+						continue
+					}
+					reqData, err := chunkMessage(messId, fileData, base+i, compressor)
+					if err != nil {
+						log.Printf("read %s chunk %d error：%s", fileData.FileName, base+i, err.Error())
+						mapLock.Lock()
+						endSession(dataMap, messId, limiter)
+						mapLock.Unlock()
+						send <- failMessage(messId, mess.Addr)
+						break
+					}
+					send <- util.IMessage{
+						Addr: mess.Addr,
+						Data: reqData,
+					}
+				}
+				// update download time
+				mapLock.Lock()
+				if fileData, exist := dataMap[messId]; exist {
+					fileData.DownloadTime = time.Now()
+					dataMap[messId] = fileData
+				}
+				mapLock.Unlock()
+			case util.Sack:
 				mapLock.Lock()
-				messId := binary.BigEndian.Uint16(data[util.MessIdIndex : util.MessIdIndex+2])
+				messId := binary.BigEndian.Uint64(data[util.MessIdIndex : util.MessIdIndex+8])
 				fileData, exist := dataMap[messId]
-				if exist {
-					messIndex := binary.BigEndian.Uint16(data[util.MessLenIndex : util.MessLenIndex+2])
-					reqData := fileData.Data[messIndex%uint16(len(fileData.Data))]
-					mess.Data = append(mess.Data[:util.MessHeadLen], reqData...)
-					send <- mess
-
-					// update download time
+				if exist && fileData.Addr.String() == mess.Addr.String() && util.SackAll(data, fileData.TotalLen()) {
+					// the client has it all, pushed or pulled
+					endSession(dataMap, messId, limiter)
+				} else if exist && fileData.Acks != nil && fileData.Addr.String() == mess.Addr.String() {
+					select {
+					case fileData.Acks <- data:
+					default:
+						// the sender is behind, a later SACK covers the same chunks
+					}
 					fileData.DownloadTime = time.Now()
 					dataMap[messId] = fileData
 				}
 				mapLock.Unlock()
+			case util.DigestMismatch:
+				mapLock.Lock()
+				messId := binary.BigEndian.Uint64(data[util.MessIdIndex : util.MessIdIndex+8])
+				fileData, exist := dataMap[messId]
+				if exist && fileData.Addr.String() == mess.Addr.String() {
+					log.Printf("client %s reports a digest mismatch for %s", mess.Addr.String(), fileData.FileName)
+					endSession(dataMap, messId, limiter)
+				}
+				mapLock.Unlock()
 			}
 		}
 	}
 }
 
-func cleanData(dataMap map[uint16]util.DownloadFile, send chan util.IMessage, lock sync.RWMutex, ctx context.Context) {
+type digestEntry struct {
+	size    int64
+	modTime time.Time
+	digest  []byte
+}
+
+// digestCache : SHA-256 of served files, kept while their size and modification time stay the same
+type digestCache struct {
+	lock    sync.Mutex
+	entries map[string]digestEntry
+	// files being digested now
+	pending map[string]struct{}
+}
+
+func newDigestCache() *digestCache {
+	return &digestCache{
+		entries: make(map[string]digestEntry),
+		pending: make(map[string]struct{}),
+	}
+}
+
+// get : the digest of the file fileName as fileStat describes it, false if it is not known yet;
+// then it is computed in another goroutine, unless MaxDigesting are running already
+func (c *digestCache) get(store util.Storage, fileName string, fileStat os.FileInfo) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, exist := c.entries[fileName]
+	if exist && entry.size == fileStat.Size() && entry.modTime.Equal(fileStat.ModTime()) {
+		return entry.digest, true
+	}
+	if _, exist := c.pending[fileName]; exist || len(c.pending) >= util.MaxDigesting {
+		return nil, false
+	}
+	c.pending[fileName] = struct{}{}
+	go func() {
+		digest, err := digestFile(store, fileName, fileStat.Size())
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		delete(c.pending, fileName)
+		if err != nil {
+			log.Printf("digest file %s error：%s", fileName, err.Error())
+			return
+		}
+		c.entries[fileName] = digestEntry{
+			size:    fileStat.Size(),
+			modTime: fileStat.ModTime(),
+			digest:  digest,
+		}
+	}()
+	return nil, false
+}
+
+// digestFile : SHA-256 of the first size bytes of the file fileName
+func digestFile(store util.Storage, fileName string, size int64) ([]byte, error) {
+	file, err := store.Open(fileName, false)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return util.FileDigest(io.NewSectionReader(file, 0, size))
+}
+
+// digestWait : how long a client is asked to wait for the digest of a file of size bytes
+func digestWait(size int64) time.Duration {
+	wait := time.Duration(size / util.DigestRate * int64(time.Second))
+	if wait < util.DigestPoll {
+		return util.DigestPoll
+	}
+	if wait > util.MaxDigestWait {
+		return util.MaxDigestWait
+	}
+	return wait
+}
+
+// initAck : fill the init message in data as the init ack of session id
+func initAck(data []byte, id uint64, downloadFile util.DownloadFile, downloadWindow uint16) []byte {
+	if data[util.InitFlagIndex]&util.InitResume != 0 {
+		// chunks asked for by NACK come without parity
+		data[util.InitFecIndex] = 0
+	}
+	// the server keeps no more chunks in flight than both sides allow
+	if w := binary.BigEndian.Uint16(data[util.InitWindowIndex : util.InitWindowIndex+2]); w == 0 || w > downloadWindow {
+		binary.BigEndian.PutUint16(data[util.InitWindowIndex:util.InitWindowIndex+2], downloadWindow)
+	}
+	binary.BigEndian.PutUint16(data[util.InitChunkIndex:util.InitChunkIndex+2], uint16(downloadFile.ChunkSize))
+	binary.BigEndian.PutUint32(data[util.MessLenIndex:util.MessLenIndex+4], downloadFile.TotalLen())
+	binary.BigEndian.PutUint64(data[util.MessIdIndex:util.MessIdIndex+8], id)
+	binary.BigEndian.PutUint64(data[util.InitSizeIndex:util.InitSizeIndex+8], uint64(downloadFile.Size))
+	copy(data[util.InitDigestIndex:util.InitDigestIndex+util.DigestLen], downloadFile.Digest)
+	data[0] = util.InitAck | util.DownloadFlag
+	return data[:util.InitHeadLen]
+}
+
+// findSession : the session an init from the same address and user for the same file already opened
+func findSession(dataMap map[uint64]util.DownloadFile, lock *sync.RWMutex, addr *net.UDPAddr, user, fileName string) (uint64, bool) {
+	lock.RLock()
+	defer lock.RUnlock()
+	for id, file := range dataMap {
+		if file.FileName == fileName && file.User == user && file.Addr.String() == addr.String() {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+func cleanData(dataMap map[uint64]util.DownloadFile, limiter *util.Limiter, send chan util.IMessage, lock *sync.RWMutex, ctx context.Context) {
 	for {
 		time.Sleep(util.DownloadCleanTime)
 		select {
@@ -125,7 +339,7 @@ func cleanData(dataMap map[uint16]util.DownloadFile, send chan util.IMessage, lo
 		}
 		lock.Lock()
 		//  remove ids
-		var ids []uint16
+		var ids []uint64
 		// uncompleted
 		now := time.Now()
 		for id, file := range dataMap {
@@ -135,57 +349,134 @@ func cleanData(dataMap map[uint16]util.DownloadFile, send chan util.IMessage, lo
 		}
 		for _, id := range ids {
 			// remove all the expired data
-			delete(dataMap, id)
+			endSession(dataMap, id, limiter)
 		}
 		lock.Unlock()
 	}
 }
 
-func sendFile(addr *net.UDPAddr, head []byte, dataSlice [][]byte, send chan util.IMessage) {
-	for index, bytes := range dataSlice {
-		var downloadBytes []byte
-		downloadBytes = append(downloadBytes, head...)
-		indexBytes := make([]byte, 2, 2)
-		binary.BigEndian.PutUint16(indexBytes, uint16(index))
-		downloadBytes = append(downloadBytes, indexBytes...)
-		downloadBytes = append(downloadBytes, bytes...)
-		go func(bytes []byte) {
+// endSession : stop the session id, close its file and release what it reserved; the caller holds
+// the lock of dataMap
+func endSession(dataMap map[uint64]util.DownloadFile, id uint64, limiter *util.Limiter) {
+	downloadFile, exist := dataMap[id]
+	if !exist {
+		return
+	}
+	close(downloadFile.Done)
+	downloadFile.File.Close()
+	limiter.Release(downloadFile.Reserved)
+	delete(dataMap, id)
+}
+
+// sendFile : push the file to the client, at most size chunks in flight until they are acked,
+// and a parity chunk after every fec chunks unless fec is 0; finish ends the session once all are
+func sendFile(id uint64, downloadFile util.DownloadFile, size int, fec uint8, finish func(), send chan util.IMessage) {
+	totalLen := downloadFile.TotalLen()
+	sender := window.NewSender(totalLen, size, nil)
+	// groups before it got their parity already
+	var parityGroup uint32
+	var compressor *util.Compressor
+	if downloadFile.Caps&util.CapCompress != 0 {
+		compressor = util.NewCompressor()
+	}
+	tick := time.NewTicker(util.WindowTick)
+	defer tick.Stop()
+	for {
+		for {
+			index, ok := sender.Next(time.Now())
+			if !ok {
+				break
+			}
+			// read one chunk at a time, the window bounds what is held in memory
+			downloadBytes, err := chunkMessage(id, downloadFile, index, compressor)
+			if err != nil {
+				log.Printf("read %s chunk %d error：%s", downloadFile.FileName, index, err.Error())
+				finish()
+				send <- failMessage(id, downloadFile.Addr)
+				return
+			}
 			mess := util.IMessage{
-				Addr: addr,
-				Data: bytes,
+				Addr: downloadFile.Addr,
+				Data: downloadBytes,
 			}
 			send <- mess
-		}(downloadBytes)
+			if fec > 0 && util.FecGroupLast(index, totalLen, fec) && util.FecGroup(index, fec) >= parityGroup {
+				// the group was sent the first time, its parity lets the client rebuild a lost chunk of it
+				parityGroup = util.FecGroup(index, fec)
+				parityBytes, err := util.ParityMessage(downloadFile.File, downloadFile.Size, downloadFile.ChunkSize, parityGroup, fec)
+				if err != nil {
+					log.Printf("read %s group %d error：%s", downloadFile.FileName, parityGroup, err.Error())
+					finish()
+					send <- failMessage(id, downloadFile.Addr)
+					return
+				}
+				parityGroup++
+				parityBytes[0] = util.DownloadFlag | util.Parity
+				binary.BigEndian.PutUint64(parityBytes[util.MessIdIndex:util.MessIdIndex+8], id)
+				util.PutChecksum(parityBytes)
+				send <- util.IMessage{
+					Addr: downloadFile.Addr,
+					Data: parityBytes,
+				}
+			}
+		}
+		select {
+		case <-downloadFile.Done:
+			return
+		case sack := <-downloadFile.Acks:
+			base := binary.BigEndian.Uint32(sack[util.MessLenIndex : util.MessLenIndex+4])
+			sender.Sack(base, sack[util.MessHeadLen:], time.Now())
+			if sender.Done() {
+				finish()
+				return
+			}
+		case <-tick.C:
+		}
 	}
 }
 
-func generateId(dataMap map[uint16]util.DownloadFile, lock sync.RWMutex) (uint16, bool) {
-	if len(dataMap) >= math.MaxUint16 {
-		return 0, false
+// chunkMessage : the chunk at index as a message of session id, compressed if both sides speak it
+// and it gets shorter
+func chunkMessage(id uint64, downloadFile util.DownloadFile, index uint32, compressor *util.Compressor) ([]byte, error) {
+	data, err := util.ReadChunk(downloadFile.File, downloadFile.Size, downloadFile.ChunkSize, index)
+	if err != nil {
+		return nil, err
 	}
-	var id uint16
-	id = uint16(rand.Intn(math.MaxUint16))
-	lock.RLock()
-	defer lock.RUnlock()
-	for {
-		_, exist := dataMap[id]
-		if !exist {
-			return id, true
+	data[0] = util.DownloadFlag | util.Normal
+	if downloadFile.Caps&util.CapCompress != 0 {
+		if compressed, ok := compressor.Compress(data); ok {
+			data = compressed
+			data[0] = util.DownloadFlag | util.Compressed
 		}
-		id++
 	}
-	return id, true
+	binary.BigEndian.PutUint64(data[util.MessIdIndex:util.MessIdIndex+8], id)
+	util.PutChecksum(data)
+	return data, nil
 }
 
-func pathExists(path string) bool {
-	_, err := os.Stat(path)
-	if err == nil {
-		return true
+// failMessage : tells the client at addr that session id ended as the file could not be read
+func failMessage(id uint64, addr *net.UDPAddr) util.IMessage {
+	data := make([]byte, util.MessHeadLen)
+	data[0] = util.DownloadFlag | util.UploadFail
+	binary.BigEndian.PutUint64(data[util.MessIdIndex:util.MessIdIndex+8], id)
+	return util.IMessage{
+		Addr: addr,
+		Data: data,
 	}
-	return false
 }
 
-func fileExists(path, fileName string) bool {
-	path = strings.TrimRight(path, string(os.PathSeparator))
-	return pathExists(path + string(os.PathSeparator) + fileName)
+// generateId : a random id no session has, nobody can guess it to get at the session of someone
+// else; false if there are too many sessions
+func generateId(dataMap map[uint64]util.DownloadFile, lock *sync.RWMutex) (uint64, bool) {
+	lock.RLock()
+	defer lock.RUnlock()
+	if len(dataMap) >= util.MaxSessions {
+		return 0, false
+	}
+	for {
+		id := util.SessionId()
+		if _, exist := dataMap[id]; !exist {
+			return id, true
+		}
+	}
 }
@@ -0,0 +1,274 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"os"
+	"server/util"
+	"testing"
+	"time"
+)
+
+const chunkSize = 512
+
+var client = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000}
+
+func initMessage(fileName string, resume, compress bool) []byte {
+	initData := make([]byte, util.InitHeadLen)
+	initData[0] = util.DownloadFlag | util.Init
+	initData[util.InitVersionIndex] = util.ProtoVersion
+	if resume {
+		initData[util.InitFlagIndex] = util.InitResume
+	}
+	binary.BigEndian.PutUint16(initData[util.InitWindowIndex:util.InitWindowIndex+2], 16)
+	if compress {
+		binary.BigEndian.PutUint16(initData[util.InitCapIndex:util.InitCapIndex+2], util.CapCompress)
+	}
+	binary.BigEndian.PutUint16(initData[util.InitChunkIndex:util.InitChunkIndex+2], chunkSize)
+	return append(initData, []byte(fileName)...)
+}
+
+func start(t *testing.T, store util.Storage, limiter *util.Limiter) (chan util.IMessage, chan util.IMessage) {
+	recv := make(chan util.IMessage)
+	send := make(chan util.IMessage, 4096)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go Download(store, util.DefaultWindow, util.MaxChunkSize, nil, limiter, recv, send, ctx)
+	return recv, send
+}
+
+// connect : init until the server acks it, it is busy while it digests the file
+func connect(t *testing.T, recv, send chan util.IMessage, initData []byte) []byte {
+	t.Helper()
+	timeout := time.After(time.Second * 5)
+	for {
+		recv <- util.IMessage{Addr: client, Data: append([]byte(nil), initData...)}
+		select {
+		case mess := <-send:
+			switch mess.Data[0] & 0x7f {
+			case util.InitAck:
+				return mess.Data
+			case util.Busy:
+				time.Sleep(time.Millisecond * 10)
+			default:
+				t.Fatalf("init answered with %d", mess.Data[0]&0x7f)
+			}
+		case <-timeout:
+			t.Fatalf("init never acked")
+		}
+	}
+}
+
+// receive : take the chunks of session id sent until all of totalLen arrived, acking each
+// if ack is set; the file put together
+func receive(t *testing.T, recv, send chan util.IMessage, id uint64, size int64, ack bool) []byte {
+	t.Helper()
+	totalLen, _ := util.ChunkCount(size, chunkSize)
+	received := util.NewBitmap(totalLen)
+	file := make([]byte, size)
+	decompressor := util.NewDecompressor()
+	timeout := time.After(time.Second * 10)
+	for received.Count() < totalLen {
+		var data []byte
+		select {
+		case mess := <-send:
+			data = mess.Data
+		case <-timeout:
+			t.Fatalf("%d of %d chunks arrived", received.Count(), totalLen)
+		}
+		code := data[0] & 0x7f
+		if code != util.Normal && code != util.Compressed {
+			continue
+		}
+		if !util.ChunkValid(data) {
+			t.Fatalf("damaged chunk")
+		}
+		if binary.BigEndian.Uint64(data[util.MessIdIndex:util.MessIdIndex+8]) != id {
+			// sent again by an earlier session before it ended
+			continue
+		}
+		index := binary.BigEndian.Uint32(data[util.MessLenIndex : util.MessLenIndex+4])
+		chunk := data[util.NormalHeadLen:]
+		if code == util.Compressed {
+			var err error
+			chunk, err = decompressor.Decompress(data, util.ChunkLen(size, chunkSize, index))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		copy(file[int64(index)*chunkSize:], chunk)
+		received.Set(index)
+		if ack {
+			sack(recv, id, received)
+		}
+	}
+	return file
+}
+
+func sack(recv chan util.IMessage, id uint64, received util.Bitmap) {
+	data := util.SackMessage(received, received.FirstClear(0))
+	data[0] = util.DownloadFlag | util.Sack
+	binary.BigEndian.PutUint64(data[util.MessIdIndex:util.MessIdIndex+8], id)
+	recv <- util.IMessage{Addr: client, Data: data}
+}
+
+func TestDownloadRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		resume   bool
+		compress bool
+	}{
+		{"small", 100, false, false},
+		{"push", chunkSize*40 + 11, false, false},
+		{"compressed", chunkSize * 40, false, true},
+		{"pull", chunkSize*40 + 11, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := util.NewMemoryStorage(0)
+			data := make([]byte, test.size)
+			rand.New(rand.NewSource(1)).Read(data[:test.size/2])
+			if err := util.WriteAtomic(store, "dir/f.bin", data); err != nil {
+				t.Fatal(err)
+			}
+			// room for one session, the next init only gets in once the first one ended
+			recv, send := start(t, store, util.NewLimiter(util.Limits{Sessions: 1}))
+			for round := 0; round < 2; round++ {
+				ack := connect(t, recv, send, initMessage("dir/f.bin", test.resume, test.compress))
+				id := binary.BigEndian.Uint64(ack[util.MessIdIndex : util.MessIdIndex+8])
+				if size := binary.BigEndian.Uint64(ack[util.InitSizeIndex : util.InitSizeIndex+8]); size != uint64(test.size) {
+					t.Fatalf("init ack has size %d, want %d", size, test.size)
+				}
+				digest, _ := util.FileDigest(bytes.NewReader(data))
+				if !bytes.Equal(ack[util.InitDigestIndex:util.InitDigestIndex+util.DigestLen], digest) {
+					t.Fatalf("init ack has another digest")
+				}
+				totalLen, _ := util.ChunkCount(int64(test.size), chunkSize)
+				if test.resume {
+					// a resuming client asks for the chunks it lacks, here all of them
+					nack := make([]byte, util.MessHeadLen, util.MessHeadLen+len(util.NewBitmap(totalLen)))
+					nack[0] = util.DownloadFlag | util.Nack
+					binary.BigEndian.PutUint64(nack[util.MessIdIndex:util.MessIdIndex+8], id)
+					missing := util.NewBitmap(totalLen)
+					for index := uint32(0); index < totalLen; index++ {
+						missing.Set(index)
+					}
+					recv <- util.IMessage{Addr: client, Data: append(nack, missing...)}
+				}
+				got := receive(t, recv, send, id, int64(test.size), !test.resume)
+				if !bytes.Equal(got, data) {
+					t.Fatalf("downloaded file differs")
+				}
+				if test.resume {
+					// the client tells it has all, which ends the session
+					all := util.NewBitmap(totalLen)
+					for index := uint32(0); index < totalLen; index++ {
+						all.Set(index)
+					}
+					sack(recv, id, all)
+				}
+			}
+		})
+	}
+}
+
+func TestDownloadRejects(t *testing.T) {
+	store := util.NewMemoryStorage(0)
+	recv, send := start(t, store, util.NewLimiter(util.Limits{}))
+	if err := util.WriteAtomic(store, "f.bin", make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		chunk uint16
+		code  byte
+	}{
+		{"../f.bin", chunkSize, util.BadFileName},
+		{"f.bin" + util.StateSuffix, chunkSize, util.BadFileName},
+		{"none.bin", chunkSize, util.FileNoExist},
+		{"f.bin", util.MinChunkSize - 1, util.BadChunkSize},
+	}
+	for _, test := range tests {
+		initData := initMessage(test.name, false, false)
+		binary.BigEndian.PutUint16(initData[util.InitChunkIndex:util.InitChunkIndex+2], test.chunk)
+		recv <- util.IMessage{Addr: client, Data: initData}
+		select {
+		case mess := <-send:
+			if code := mess.Data[0] & 0x7f; code != test.code {
+				t.Errorf("init of %q answered with %d, want %d", test.name, code, test.code)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("init of %q not answered", test.name)
+		}
+	}
+}
+
+func TestDownloadReadFail(t *testing.T) {
+	store := util.NewMemoryStorage(0)
+	data := make([]byte, chunkSize*200)
+	if err := util.WriteAtomic(store, "f.bin", data); err != nil {
+		t.Fatal(err)
+	}
+	recv, send := start(t, store, util.NewLimiter(util.Limits{Sessions: 1}))
+	ack := connect(t, recv, send, initMessage("f.bin", false, false))
+	id := binary.BigEndian.Uint64(ack[util.MessIdIndex : util.MessIdIndex+8])
+
+	// the file is cut short under the session, the chunks past the first window cannot be read
+	f, err := store.Open("f.bin", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(chunkSize); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	received := util.NewBitmap(200)
+	received.Set(0)
+	sack(recv, id, received)
+	timeout := time.After(time.Second * 5)
+	for failed := false; !failed; {
+		select {
+		case mess := <-send:
+			failed = mess.Data[0]&0x7f == util.UploadFail &&
+				binary.BigEndian.Uint64(mess.Data[util.MessIdIndex:util.MessIdIndex+8]) == id
+		case <-timeout:
+			t.Fatal("client not told the download failed")
+		}
+	}
+
+	// the session ended and its room is free again
+	if err := util.WriteAtomic(store, "f.bin", data); err != nil {
+		t.Fatal(err)
+	}
+	connect(t, recv, send, initMessage("f.bin", false, false))
+}
+
+// unreadable : a storage whose files are there but cannot be opened
+type unreadable struct {
+	util.Storage
+}
+
+func (unreadable) Open(name string, write bool) (util.File, error) {
+	return nil, os.ErrPermission
+}
+
+func TestDownloadOpenFail(t *testing.T) {
+	store := util.NewMemoryStorage(0)
+	if err := util.WriteAtomic(store, "f.bin", make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	recv, send := start(t, unreadable{store}, util.NewLimiter(util.Limits{}))
+	recv <- util.IMessage{Addr: client, Data: initMessage("f.bin", false, false)}
+	select {
+	case mess := <-send:
+		if code := mess.Data[0] & 0x7f; code != util.UploadFail {
+			t.Errorf("init of a file that cannot be opened answered with %d", code)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("init of a file that cannot be opened not answered")
+	}
+}
@@ -1,7 +1,13 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"log"
 	"net"
 	"os"
@@ -10,11 +16,16 @@ import (
 	"server/send"
 	"server/upload"
 	"server/util"
+	"strings"
 	"time"
 )
 
 func main() {
 	cmd := NewCmd()
+	if cmd.AddUser != "" {
+		addUser(cmd.Users, cmd.AddUser)
+		return
+	}
 	udpAddr, err := net.ResolveUDPAddr("udp", ":"+cmd.Port)
 	if err != nil {
 		log.Printf("resolve port %s error %s\n", cmd.Port, err.Error())
@@ -27,24 +38,106 @@ func main() {
 	uploadChan := make(chan util.IMessage, util.UploadChanCnt)
 	downloadChan := make(chan util.IMessage, util.DownloadChanCnt)
 	sendChan := make(chan util.IMessage, util.SendChanCnt)
+	var psk []byte
+	if cmd.Psk != "" {
+		psk, err = loadPsk(cmd.Psk)
+		if err != nil {
+			log.Printf("load pre-shared key %s error %s", cmd.Psk, err.Error())
+			return
+		}
+	}
+	var keyring *util.Keyring
+	if cmd.Psk != "" || cmd.HostKey != "" {
+		keyring, err = util.NewKeyring(psk)
+		if err != nil {
+			log.Printf("derive keys error %s", err.Error())
+			return
+		}
+	}
+	if cmd.HostKey != "" {
+		hostKey, err := loadHostKey(cmd.HostKey)
+		if err != nil {
+			log.Printf("load host key %s error %s", cmd.HostKey, err.Error())
+			return
+		}
+		keyring.SetHostKey(hostKey)
+		log.Printf("host key %s", base64.StdEncoding.EncodeToString(hostKey.Public().(ed25519.PublicKey)))
+	}
+	var users util.Users
+	if cmd.Users != "" {
+		users, err = util.LoadUsers(cmd.Users)
+		if err != nil {
+			log.Printf("load users %s error %s", cmd.Users, err.Error())
+			return
+		}
+		log.Printf("%d users allowed in", len(users))
+	}
+	var acl *util.ACL
+	if cmd.Acl != "" {
+		acl, err = util.LoadACL(cmd.Acl)
+		if err != nil {
+			log.Printf("load acl %s error %s", cmd.Acl, err.Error())
+			return
+		}
+	}
+	// answers go only to addresses proven to receive, beyond a little more than they sent
+	validator := util.NewValidator()
+	limiter := util.NewLimiter(util.Limits{
+		IPPackets:  cmd.IPPackets,
+		IPBytes:    cmd.IPBytes,
+		IPSessions: cmd.IPSessions,
+		Sessions:   cmd.Sessions,
+		Memory:     cmd.Memory,
+	})
 	bgCtx := context.Background()
 	ctx, cancel := context.WithCancel(bgCtx)
 	// turn on receive module
-	go recv.Recv(udpConn, uploadChan, downloadChan, ctx)
+	go recv.Recv(udpConn, uploadChan, downloadChan, sendChan, keyring, users, validator, limiter, ctx)
 	// turn on send module
-	go send.Send(udpConn, sendChan, ctx)
+	go send.Send(udpConn, sendChan, keyring, validator, ctx)
 
-	// if storage path no exist,exit
-	if !pathExists(cmd.StoragePath) {
-		log.Printf("path %s no exist\n", cmd.StoragePath)
+	var store util.Storage
+	if cmd.MemStore > 0 {
+		store = util.NewMemoryStorage(cmd.MemStore)
+	} else {
+		// if storage path no exist,exit
+		if !pathExists(cmd.StoragePath) {
+			log.Printf("path %s no exist\n", cmd.StoragePath)
+			cancel()
+			time.Sleep(util.ExitTime)
+			return
+		}
+		store = util.NewLocalStorage(cmd.StoragePath)
+	}
+	if cmd.Chunk < util.MinChunkSize || cmd.Chunk > util.MaxChunkSize {
+		log.Printf("chunk size %d out of %d-%d\n", cmd.Chunk, util.MinChunkSize, util.MaxChunkSize)
+		cancel()
+		time.Sleep(util.ExitTime)
+		return
+	}
+	if cmd.Window < 1 || cmd.Window > util.MaxWindow {
+		log.Printf("window %d out of 1-%d\n", cmd.Window, util.MaxWindow)
+		cancel()
+		time.Sleep(util.ExitTime)
+		return
+	}
+	if cmd.Quota > 0 && cmd.Usage == "" {
+		log.Printf("-quota needs a -usage file to count what users stored\n")
+		cancel()
+		time.Sleep(util.ExitTime)
+		return
+	}
+	quota, err := util.LoadQuota(store, cmd.Usage, cmd.MaxSize, cmd.Quota, cmd.MinFree)
+	if err != nil {
+		log.Printf("load usage %s error %s", cmd.Usage, err.Error())
 		cancel()
 		time.Sleep(util.ExitTime)
 		return
 	}
 	// turn on upload module
-	go upload.Upload(cmd.StoragePath, uploadChan, sendChan, ctx)
+	go upload.Upload(store, uint16(cmd.Window), int(cmd.Chunk), acl, limiter, quota, uploadChan, sendChan, ctx)
 	// turn on download module
-	go download.Download(cmd.StoragePath, downloadChan, sendChan, ctx)
+	go download.Download(store, uint16(cmd.Window), int(cmd.Chunk), acl, limiter, downloadChan, sendChan, ctx)
 	defer func() {
 		cancel()
 		time.Sleep(util.ExitTime)
@@ -53,6 +146,66 @@ func main() {
 	<-ctx.Done()
 }
 
+// addUser : add user with the password on the first line of stdin to the credentials file at path
+func addUser(path, user string) {
+	if path == "" {
+		log.Printf("-adduser needs the -users file")
+		return
+	}
+	fmt.Printf("password of %s: ", user)
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		log.Printf("read password error %s", err.Error())
+		return
+	}
+	err = util.AddUser(path, user, strings.TrimRight(password, "\r\n"))
+	if err != nil {
+		log.Printf("add user %s error %s", user, err.Error())
+		return
+	}
+	log.Printf("added user %s to %s", user, path)
+}
+
+// loadHostKey : the host key kept in path, a new one is created there if there is none
+func loadHostKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		seed := base64.StdEncoding.EncodeToString(hostKey.Seed())
+		return hostKey, os.WriteFile(path, []byte(seed+"\n"), 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.New("bad host key")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// loadPsk : the pre-shared key in the file at path, a new random one is written there if missing
+func loadPsk(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		psk := make([]byte, util.PskLen)
+		if _, err := rand.Read(psk); err != nil {
+			return nil, err
+		}
+		return psk, os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(psk)+"\n"), 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+}
+
 func pathExists(path string) bool {
 	_, err := os.Stat(path)
 	if err == nil {
@@ -8,7 +8,11 @@ import (
 	"time"
 )
 
-func Recv(udpConn *net.UDPConn, upload, download chan util.IMessage, ctx context.Context) {
+// Recv : hand the messages read from udpConn to the upload and download modules, those that fail
+// authentication dropped if keyring is not nil. Init must echo a cookie of validator, with users
+// it must also prove its user
+func Recv(udpConn *net.UDPConn, upload, download, send chan util.IMessage, keyring *util.Keyring, users util.Users,
+	validator *util.Validator, limiter *util.Limiter, ctx context.Context) {
 	if udpConn == nil {
 		log.Printf("udpConn is nil\n")
 		return
@@ -20,7 +24,7 @@ func Recv(udpConn *net.UDPConn, upload, download chan util.IMessage, ctx context
 			return
 		default:
 		}
-		data := make([]byte, util.MaxLen+util.MessHeadLen, util.MaxLen+util.MessHeadLen)
+		data := make([]byte, util.MaxDatagram, util.MaxDatagram)
 		// set read timeout
 		udpConn.SetDeadline(time.Now().Add(util.ReadTimeout))
 		n, addr, err := udpConn.ReadFromUDP(data)
@@ -28,23 +32,115 @@ func Recv(udpConn *net.UDPConn, upload, download chan util.IMessage, ctx context
 			//log.Printf("ReadFromUDP from %s, error: %s\n", addr.String(), err.Error())
 			continue
 		}
+		validator.Received(addr, n)
 		if n < util.MessHeadLen {
 			continue
 		}
-		go process(data[:n], upload, download, addr)
+		// hand messages on in the order they arrived, selective acks take reordering for loss
+		process(data[:n], upload, download, send, keyring, users, validator, limiter, addr, ctx)
 	}
 }
 
-func process(messData []byte, upload, download chan util.IMessage, addr *net.UDPAddr) {
+func process(messData []byte, upload, download, send chan util.IMessage, keyring *util.Keyring, users util.Users,
+	validator *util.Validator, limiter *util.Limiter, addr *net.UDPAddr, ctx context.Context) {
+	if wait, ok := limiter.Packet(addr, len(messData)); !ok {
+		// over the limits of its ip, dropped before any work is spent on it; the head is
+		// readable even if sealed, an init hears when to try again
+		if messData[0]&0x7f == util.Init {
+			select {
+			case send <- util.IMessage{Addr: addr, Data: util.BusyMessage(messData, wait)}:
+			case <-ctx.Done():
+			}
+		}
+		return
+	}
+	if keyring != nil {
+		var ok bool
+		messData, ok = keyring.Open(addr, messData)
+		if !ok {
+			// not sealed with the pre-shared key, or forged
+			return
+		}
+	}
 	flag := messData[0] & 0x80
 	mess := util.IMessage{
 		Addr: addr,
 		Data: messData,
 	}
-	switch flag {
-	case util.UploadFlag:
-		upload <- mess
-	case util.DownloadFlag:
-		download <- mess
+	switch messData[0] & 0x7f {
+	case util.Hello:
+		// a key exchange, answered here, no module takes part in it
+		if keyring == nil || len(messData) != util.HelloLen {
+			return
+		}
+		if !validator.Check(addr, messData[util.HelloCookieIndex:util.HelloCookieIndex+util.CookieLen]) {
+			// no key is exchanged with an address that may be spoofed
+			mess.Data = validator.Retry(addr, messData)
+			select {
+			case send <- mess:
+			case <-ctx.Done():
+			}
+			return
+		}
+		ack, ok := keyring.Hello(addr, messData)
+		if !ok {
+			return
+		}
+		mess.Data = ack
+		select {
+		case send <- mess:
+		case <-ctx.Done():
+		}
+		return
+	case util.HelloAck:
+		return
+	}
+	if messData[0]&0x7f == util.Init {
+		// a peer speaking another wire format is rejected before any module sees it,
+		// optional capabilities only one side speaks are dropped
+		code, ok := util.NegotiateInit(messData)
+		if ok && !validator.Check(addr, messData[util.InitCookieIndex:util.InitCookieIndex+util.CookieLen]) {
+			// the address may be spoofed, nothing is set up for it before it echoes a cookie
+			mess.Data = validator.Retry(addr, messData)
+			select {
+			case send <- mess:
+			case <-ctx.Done():
+			}
+			return
+		}
+		if ok && users != nil {
+			// the identity is carried along with the session from here on
+			mess.User, ok = users.Verify(messData, time.Now())
+			if !ok {
+				code = util.AuthFail
+			}
+		}
+		if !ok {
+			log.Printf("reject init from %s, code %d", addr.String(), code)
+			messData[0] = flag | code
+			mess.Data = messData[:util.MessHeadLen]
+			select {
+			case send <- mess:
+			case <-ctx.Done():
+			}
+			return
+		}
+		if wait, ok := limiter.NewSession(addr); !ok {
+			log.Printf("%s starts sessions too fast", addr.String())
+			mess.Data = util.BusyMessage(messData, wait)
+			select {
+			case send <- mess:
+			case <-ctx.Done():
+			}
+			return
+		}
+	}
+	dest := upload
+	if flag == util.DownloadFlag {
+		dest = download
+	}
+	select {
+	case dest <- mess:
+	case <-ctx.Done():
 	}
 }
@@ -7,14 +7,29 @@ import (
 	"server/util"
 )
 
-func Send(udpConn *net.UDPConn, send chan util.IMessage, ctx context.Context) {
+// Send : write the messages from send to udpConn, sealed if keyring is not nil, as far as
+// validator allows sending to their address
+func Send(udpConn *net.UDPConn, send chan util.IMessage, keyring *util.Keyring, validator *util.Validator, ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
 			log.Printf("Send goroutine exit\n")
 			return
 		case mess := <-send:
-			go udpConn.WriteToUDP(mess.Data, mess.Addr)
+			data := mess.Data
+			if keyring != nil {
+				data = keyring.Seal(mess.Addr, data)
+				if data == nil {
+					// no key for the peer yet, nothing goes out in the clear
+					continue
+				}
+			}
+			if !validator.Allow(mess.Addr, len(data)) {
+				// the address never proved to receive, it may be the victim of a spoofed message
+				continue
+			}
+			// write in order, selective acks take reordering for loss
+			udpConn.WriteToUDP(data, mess.Addr)
 		}
 	}
 }
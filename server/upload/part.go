@@ -0,0 +1,151 @@
+package upload
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"server/util"
+	"strings"
+	"time"
+)
+
+// resume state layout: file size(8) | chunk size(2) | file digest(32) | bitmap of received chunks
+const stateHeadLen = 8 + 2 + util.DigestLen
+
+func partPath(fileName string) string {
+	return fileName + util.PartSuffix
+}
+
+func statePath(partPath string) string {
+	return partPath + util.StateSuffix
+}
+
+// openPart : open the part file of an upload, continuing the chunks of an earlier upload
+// of the same content if resume is set and its state is still there
+func openPart(store util.Storage, fileName string, size int64, chunkSize int, digest []byte, resume bool) (util.UploadFile, error) {
+	totalLen, _ := util.ChunkCount(size, chunkSize)
+	uploadFile := util.UploadFile{
+		Filename:  fileName,
+		Size:      size,
+		ChunkSize: chunkSize,
+		TotalLen:  totalLen,
+		Digest:    append([]byte(nil), digest...),
+	}
+	part := partPath(fileName)
+	if resume {
+		received, err := loadState(store, part, size, chunkSize, digest)
+		if err == nil {
+			f, err := store.Open(part, true)
+			if err == nil {
+				uploadFile.File = f
+				uploadFile.Received = received
+				uploadFile.CurrLen = received.Count()
+				uploadFile.Saved = uploadFile.CurrLen
+				if uploadFile.CurrLen == totalLen {
+					// stored everything but never finished, the last chunk sent again finishes it
+					received.Clear(totalLen - 1)
+					uploadFile.CurrLen--
+				}
+				return uploadFile, nil
+			}
+		}
+	}
+	// nothing to continue, start over
+	store.Delete(statePath(part))
+	f, err := createFile(store, part, size)
+	if err != nil {
+		return uploadFile, err
+	}
+	uploadFile.File = f
+	uploadFile.Received = util.NewBitmap(totalLen)
+	return uploadFile, nil
+}
+
+// saveState : flush the part file and record which chunks it holds
+func saveState(store util.Storage, uploadFile *util.UploadFile) error {
+	err := uploadFile.File.Sync()
+	if err != nil {
+		return err
+	}
+	data := make([]byte, stateHeadLen, stateHeadLen+len(uploadFile.Received))
+	binary.BigEndian.PutUint64(data[:8], uint64(uploadFile.Size))
+	binary.BigEndian.PutUint16(data[8:10], uint16(uploadFile.ChunkSize))
+	copy(data[10:], uploadFile.Digest)
+	data = append(data, uploadFile.Received...)
+	err = util.WriteAtomic(store, statePath(partPath(uploadFile.Filename)), data)
+	if err != nil {
+		return err
+	}
+	uploadFile.Saved = uploadFile.CurrLen
+	return nil
+}
+
+func loadState(store util.Storage, part string, size int64, chunkSize int, digest []byte) (util.Bitmap, error) {
+	data, err := util.ReadFile(store, statePath(part))
+	if err != nil {
+		return nil, err
+	}
+	totalLen, _ := util.ChunkCount(size, chunkSize)
+	received := util.NewBitmap(totalLen)
+	if len(data) != stateHeadLen+len(received) {
+		return nil, errors.New("bad resume state")
+	}
+	if int64(binary.BigEndian.Uint64(data[:8])) != size || !bytes.Equal(data[10:stateHeadLen], digest) {
+		return nil, errors.New("resume state of other content")
+	}
+	if int(binary.BigEndian.Uint16(data[8:10])) != chunkSize {
+		return nil, errors.New("resume state of another chunk size")
+	}
+	copy(received, data[stateHeadLen:])
+	return received, nil
+}
+
+func removePart(store util.Storage, part string) {
+	store.Delete(part)
+	store.Delete(statePath(part))
+}
+
+// listParts : part files in store, left by an earlier run or by sessions not cleaned up yet
+func listParts(store util.Storage) map[string]struct{} {
+	names, err := store.List()
+	if err != nil {
+		log.Printf("list storage error：%s", err.Error())
+	}
+	parts := make(map[string]struct{})
+	for _, name := range names {
+		if strings.HasSuffix(name, util.PartSuffix) {
+			parts[name] = struct{}{}
+		}
+	}
+	return parts
+}
+
+// cleanParts : remove part files nobody continued within PartKeepTime. Only the part files in
+// parts are looked at, rather than the whole storage each time; a part file is made only by a
+// session, which is active at some clean before it ends unless it stored or removed its file
+func cleanParts(store util.Storage, parts, active map[string]struct{}) {
+	for name := range active {
+		parts[name] = struct{}{}
+	}
+	now := time.Now()
+	for name := range parts {
+		if _, exist := active[name]; exist {
+			continue
+		}
+		info, err := store.Stat(name)
+		if err != nil {
+			// stored or removed since
+			delete(parts, name)
+			continue
+		}
+		modTime := info.ModTime()
+		if stateInfo, err := store.Stat(statePath(name)); err == nil && stateInfo.ModTime().After(modTime) {
+			modTime = stateInfo.ModTime()
+		}
+		if modTime.Add(util.PartKeepTime).Before(now) {
+			removePart(store, name)
+			delete(parts, name)
+		}
+	}
+}
@@ -1,34 +1,131 @@
 package upload
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
+	"io"
 	"log"
-	"math"
-	"math/rand"
+	"net"
 	"os"
 	"server/util"
-	"strings"
 	"sync"
 	"time"
 )
 
-func Upload(storagePath string, recv, send chan util.IMessage, ctx context.Context) {
-	dataMap := make(map[uint16]util.UploadFile, 256)
+func Upload(store util.Storage, uploadWindow uint16, maxChunk int, acl *util.ACL, limiter *util.Limiter, quota *util.Quota,
+	recv, send chan util.IMessage, ctx context.Context) {
+	dataMap := make(map[uint64]util.UploadFile, 256)
+	// uploads whose chunks all arrived, by session id
+	commits := make(map[uint64]commit)
 	var mapLock sync.RWMutex
 	// turn on clean data goroutine
-	go cleanData(dataMap, send, mapLock, ctx)
+	go cleanData(store, dataMap, commits, limiter, quota, send, &mapLock, ctx)
+	decompressor := util.NewDecompressor()
+	tick := time.NewTicker(util.WindowTick)
+	defer tick.Stop()
 	for {
 		select {
 		case <-ctx.Done():
 			return
+		case <-tick.C:
+			// ack chunks that arrived since the last SACK
+			mapLock.Lock()
+			for id, uf := range dataMap {
+				if uf.Unacked > 0 {
+					send <- sack(id, &uf)
+					dataMap[id] = uf
+				}
+			}
+			mapLock.Unlock()
 		case mess := <-recv:
 			data := mess.Data
 			funcCode := data[0] & 0x7f
 			switch funcCode {
 			case util.Init:
-				fileName := string(data[util.MessHeadLen:])
-				exist := fileExists(storagePath, fileName)
+				fileName, ok := util.CleanName(util.InitFileName(data))
+				if !ok {
+					log.Printf("bad file name %q from %s", util.InitFileName(data), mess.Addr.String())
+					data[0] = util.UploadFlag | util.BadFileName
+					mess.Data = data[:util.MessHeadLen]
+					send <- mess
+					continue
+				}
+				if !acl.Allowed(mess.User, fileName, util.PermWrite) {
+					// checked first, whether the file exists is none of the business of the user
+					log.Printf("user %q may not write %s", mess.User, fileName)
+					data[0] = util.UploadFlag | util.PermissionDenied
+					mess.Data = data[:util.MessHeadLen]
+					send <- mess
+					continue
+				}
+				if util.Outside(store, fileName) {
+					log.Printf("%s leads out of the storage path", fileName)
+					data[0] = util.UploadFlag | util.BadFileName
+					mess.Data = data[:util.MessHeadLen]
+					send <- mess
+					continue
+				}
+				digest := data[util.InitDigestIndex : util.InitDigestIndex+util.DigestLen]
+				size := int64(binary.BigEndian.Uint64(data[util.InitSizeIndex : util.InitSizeIndex+8]))
+				resume := data[util.InitFlagIndex]&util.InitResume != 0
+				fec := data[util.InitFecIndex]
+				caps := binary.BigEndian.Uint16(data[util.InitCapIndex : util.InitCapIndex+2])
+				chunkSize := util.InitChunkSize(data, maxChunk)
+				if id, ok := findSession(dataMap, &mapLock, fileName); ok {
+					mapLock.Lock()
+					uf := dataMap[id]
+					same := uf.User == mess.User && uf.Size == size && bytes.Equal(uf.Digest, digest) && uf.ChunkSize <= chunkSize
+					moved := uf.Addr.String() != mess.Addr.String()
+					if quiet := time.Since(uf.UpdateTime); same && resume && moved && quiet < util.TakeoverTime {
+						// anyone can claim to be the client come back from another address, the session is
+						// only handed over once its own address has gone quiet
+						mapLock.Unlock()
+						log.Printf("%s asks for the live upload of %s from %s", mess.Addr.String(), fileName, uf.Addr.String())
+						mess.Data = util.BusyMessage(data, util.TakeoverTime-quiet)
+						send <- mess
+						continue
+					}
+					if same && (!moved || resume) {
+						// the init ack was lost, or the client came back from another address
+						if uf.Fec != fec {
+							// parities of another group size take another share of memory
+							reserved := util.SessionMemory(uf.TotalLen, uf.ChunkSize, uploadWindow, fec)
+							if wait, ok := limiter.Resize(uf.Reserved, reserved); !ok {
+								mapLock.Unlock()
+								mess.Data = util.BusyMessage(data, wait)
+								send <- mess
+								continue
+							}
+							uf.Reserved = reserved
+							uf.Fec = fec
+							uf.Parity = make(util.Parities)
+							uf.ParityKeep = util.ParityKeep(uploadWindow, fec)
+						}
+						uf.Addr = mess.Addr
+						uf.Caps = caps
+						uf.UpdateTime = time.Now()
+						dataMap[id] = uf
+						mess.Data = initAck(data, id, uf, uploadWindow)
+						mapLock.Unlock()
+						send <- mess
+						continue
+					}
+					mapLock.Unlock()
+					// someone else is uploading other content under this name
+					data[0] = util.FileExist
+					mess.Data = data
+					send <- mess
+					continue
+				}
+				if storing(commits, &mapLock, fileName) {
+					// its part file is still being verified and moved into place, creating it again would
+					// cut it short; by the time the client asks again the file exists or is gone
+					mess.Data = util.BusyMessage(data, util.CommitPoll)
+					send <- mess
+					continue
+				}
+				exist := util.Exists(store, fileName)
 				if exist {
 					//file exists
 					data[0] = util.FileExist
@@ -36,58 +133,237 @@ func Upload(storagePath string, recv, send chan util.IMessage, ctx context.Conte
 					send <- mess
 					continue
 				}
-				id, ok := generateId(dataMap, mapLock)
+				// the client counts chunks of the size it asked for
+				totalLen, ok := util.ChunkCount(size, util.InitChunkSize(data, util.MaxChunkSize))
+				if !ok || chunkSize < util.MinChunkSize {
+					data[0] = util.UploadFlag | util.BadChunkSize
+					mess.Data = data[:util.MessHeadLen]
+					send <- mess
+					continue
+				}
+				if totalLen != binary.BigEndian.Uint32(data[util.MessLenIndex:util.MessLenIndex+4]) {
+					data[0] = util.UploadFlag | util.UploadFail
+					mess.Data = data[:util.MessHeadLen]
+					send <- mess
+					continue
+				}
+				if !quota.Reserve(mess.User, size) {
+					log.Printf("no room for %s of %d bytes from user %q", fileName, size, mess.User)
+					data[0] = util.UploadFlag | util.QuotaExceeded
+					mess.Data = data[:util.MessHeadLen]
+					send <- mess
+					continue
+				}
+				reserved := util.SessionMemory(totalLen, chunkSize, uploadWindow, fec)
+				if wait, ok := limiter.Reserve(reserved); !ok {
+					quota.Release(mess.User, size)
+					mess.Data = util.BusyMessage(data, wait)
+					send <- mess
+					continue
+				}
+				id, ok := generateId(dataMap, &mapLock)
 				if !ok {
-					// fail,return busy code
-					data[0] = util.Busy
-					mess.Data = data
+					limiter.Release(reserved)
+					quota.Release(mess.User, size)
+					mess.Data = util.BusyMessage(data, util.BusyWait)
 					send <- mess
 					continue
 				}
-				var totalLen uint16
-				totalLen = binary.BigEndian.Uint16(data[util.MessLenIndex : util.MessLenIndex+2])
-				uploadFile := util.UploadFile{
-					Filename:   fileName,
-					Addr:       mess.Addr,
-					TotalLen:   totalLen,
-					CurrLen:    0,
-					Data:       make([][]byte, totalLen),
-					UpdateTime: time.Now(),
+				uploadFile, err := openPart(store, fileName, size, chunkSize, digest, resume)
+				if err != nil {
+					limiter.Release(reserved)
+					quota.Release(mess.User, size)
+					log.Printf("create file %s error：%s", fileName, err.Error())
+					data[0] = util.UploadFlag | util.UploadFail
+					mess.Data = data[:util.MessHeadLen]
+					send <- mess
+					continue
+				}
+				if uploadFile.CurrLen > 0 {
+					log.Printf("resume %s with %d of %d chunks", fileName, uploadFile.CurrLen, uploadFile.TotalLen)
 				}
+				uploadFile.Addr = mess.Addr
+				uploadFile.User = mess.User
+				uploadFile.Reserved = reserved
+				uploadFile.Caps = caps
+				uploadFile.Fec = fec
+				uploadFile.Parity = make(util.Parities)
+				uploadFile.ParityKeep = util.ParityKeep(uploadWindow, fec)
+				uploadFile.UpdateTime = time.Now()
 				mapLock.Lock()
 				dataMap[id] = uploadFile
 				mapLock.Unlock()
-				binary.BigEndian.PutUint16(data[util.MessIdIndex:util.MessIdIndex+2], id)
-				data[0] = util.InitAck | util.UploadFlag
-				mess.Data = data
+				mess.Data = initAck(data, id, uploadFile, uploadWindow)
 				// init ack
 				send <- mess
-			case util.Normal:
+			case util.Probe:
+				// a short answer, the client learns the probe of this size got through whole
+				if len(data) == int(binary.BigEndian.Uint32(data[util.MessLenIndex:util.MessLenIndex+4])) {
+					data[0] = util.UploadFlag | util.ProbeAck
+					mess.Data = data[:util.MessHeadLen]
+					send <- mess
+				}
+			case util.ResumeQuery:
+				mapLock.RLock()
+				id := binary.BigEndian.Uint64(data[util.MessIdIndex : util.MessIdIndex+8])
+				uf, exist := dataMap[id]
+				base := binary.BigEndian.Uint32(data[util.MessLenIndex : util.MessLenIndex+4])
+				if exist && uf.Addr.String() == mess.Addr.String() && base < uf.TotalLen && base%8 == 0 {
+					// answer with the bitmap of received chunks from base on, as much as fits
+					begin := base / 8
+					end := begin + util.MaxLen
+					if end > uint32(len(uf.Received)) {
+						end = uint32(len(uf.Received))
+					}
+					state := append(data[:util.MessHeadLen], uf.Received[begin:end]...)
+					state[0] = util.UploadFlag | util.ResumeState
+					mess.Data = state
+					send <- mess
+				}
+				mapLock.RUnlock()
+			case util.UploadCommitted:
+				// the client asks how its upload ended
+				mapLock.RLock()
+				id := binary.BigEndian.Uint64(data[util.MessIdIndex : util.MessIdIndex+8])
+				c, exist := commits[id]
+				mapLock.RUnlock()
+				if !exist || c.addr.String() != mess.Addr.String() {
+					continue
+				}
+				if c.code == util.Busy {
+					// still storing, the client waits a little and asks again
+					mess.Data = util.BusyMessage(data, util.CommitPoll)
+				} else {
+					mess.Data = commitMessage(id, c.code)
+				}
+				send <- mess
+			case util.Normal, util.Parity, util.Compressed:
 				mapLock.Lock()
-				var id uint16
-				id = binary.BigEndian.Uint16(data[util.MessIdIndex : util.MessIdIndex+2])
+				id := binary.BigEndian.Uint64(data[util.MessIdIndex : util.MessIdIndex+8])
 				uf, exist := dataMap[id]
-				if exist {
-					index := binary.BigEndian.Uint16(data[util.MessLenIndex : util.MessLenIndex+2])
-					// Determine whether the corresponding fragment has been uploaded
-					if len(uf.Data[index%uf.TotalLen]) == 0 {
-						uf.Data[index%uf.TotalLen] = append(uf.Data[index%uf.TotalLen], data[util.MessHeadLen:]...)
-						uf.CurrLen++
-						uf.UpdateTime = time.Now()
+				if c, done := commits[id]; !exist && done && c.addr.String() == mess.Addr.String() {
+					// sent again after all chunks arrived, the final SACK or the end got lost
+					if c.code == util.Busy {
+						mess.Data = c.ack
+					} else {
+						mess.Data = commitMessage(id, c.code)
+					}
+					send <- mess
+				}
+				// a session is only good from the address that started it, or took it over by init
+				if exist && uf.Addr.String() == mess.Addr.String() {
+					if !util.ChunkValid(data) {
+						// damaged on the way, drop it and let the client send it again
+						uf.Corrupt++
 						dataMap[id] = uf
-						ack := data[:util.MessHeadLen]
-						ack[0] = util.NormalAck
-						if uf.TotalLen == uf.CurrLen {
-							// recv all data,storage it
-							go storage(storagePath, uf)
+						mapLock.Unlock()
+						continue
+					}
+					index := binary.BigEndian.Uint32(data[util.MessLenIndex : util.MessLenIndex+4])
+					// the group a parity can complete
+					var group uint32
+					if funcCode == util.Parity {
+						group = index
+						if uf.Fec == 0 || group > util.FecGroup(uf.TotalLen-1, uf.Fec) ||
+							len(data)-util.NormalHeadLen != util.ParityLen(uf.Size, uf.ChunkSize, group, uf.Fec) {
+							mapLock.Unlock()
+							continue
+						}
+						uf.Parity.Add(group, data[util.NormalHeadLen:], uf.ParityKeep)
+					} else {
+						if index >= uf.TotalLen || (funcCode == util.Compressed && uf.Caps&util.CapCompress == 0) {
+							mapLock.Unlock()
+							continue
+						}
+						// Determine whether the corresponding fragment has been uploaded
+						if uf.Received.Has(index) {
+							// sent again, the SACK covering it was lost
+							send <- sack(id, &uf)
+							dataMap[id] = uf
+							mapLock.Unlock()
+							continue
+						}
+						chunk := data[util.NormalHeadLen:]
+						if funcCode == util.Compressed {
+							var err error
+							chunk, err = decompressor.Decompress(data, util.ChunkLen(uf.Size, uf.ChunkSize, index))
+							if err != nil {
+								uf.Corrupt++
+								dataMap[id] = uf
+								mapLock.Unlock()
+								continue
+							}
+						}
+						if len(chunk) != util.ChunkLen(uf.Size, uf.ChunkSize, index) {
+							// truncated chunk, drop it
+							mapLock.Unlock()
+							continue
+						}
+						err := put(&uf, index, chunk)
+						if err != nil {
+							// no ack, the client will send it again
+							log.Printf("write %s chunk %d error：%s", uf.Filename, index, err.Error())
+							mapLock.Unlock()
+							continue
+						}
+					}
+					if uf.Fec > 0 {
+						if funcCode != util.Parity {
+							group = util.FecGroup(index, uf.Fec)
+						}
+						// rebuild the chunk lost from the group without waiting for it
+						lost, chunk, ok := uf.Parity.Recover(uf.File, uf.Size, uf.ChunkSize, uf.Received, group, uf.Fec)
+						if ok {
+							err := put(&uf, lost, chunk)
+							if err != nil {
+								log.Printf("write %s chunk %d error：%s", uf.Filename, lost, err.Error())
+							}
+						}
+					}
+					uf.UpdateTime = time.Now()
+					if uf.TotalLen == uf.CurrLen {
+						// recv all data, ack it at once and storage it, the client learns how that ended apart
+						ack := sack(id, &uf)
+						send <- ack
+						commits[id] = commit{
+							name: uf.Filename,
+							addr: uf.Addr,
+							ack:  ack.Data,
+							code: util.Busy,
+						}
+						go storage(store, id, uf, quota, commits, &mapLock, send)
+						limiter.Release(uf.Reserved)
+						delete(dataMap, id)
+						mapLock.Unlock()
+						continue
+					}
+					if uf.CurrLen-uf.Saved >= util.StateSaveChunks {
+						// keep what arrived so far resumable
+						err := saveState(store, &uf)
+						if err != nil {
+							log.Printf("save state of %s error：%s", uf.Filename, err.Error())
+						}
+						// part files are sparse, the disk fills as chunks arrive
+						if quota.DiskLow(int64(uf.TotalLen-uf.CurrLen) * int64(uf.ChunkSize)) {
+							// stop before the disk is full, what arrived can be resumed once there is room
+							log.Printf("disk is low on space, stop uploading %s", uf.Filename)
+							uf.File.Close()
+							limiter.Release(uf.Reserved)
+							quota.Release(uf.User, uf.Size)
 							delete(dataMap, id)
+							mapLock.Unlock()
+							data[0] = util.UploadFlag | util.QuotaExceeded
+							mess.Data = data[:util.MessHeadLen]
+							send <- mess
+							continue
 						}
 					}
-					// ack
-					ack := data[:util.MessHeadLen]
-					ack[0] = util.UploadFlag | util.NormalAck
-					mess.Data = ack
-					send <- mess
+					// with parity, wait for the end of a group, a chunk the parity rebuilds is not lost
+					if uf.Unacked >= util.SackChunks &&
+						(uf.Fec == 0 || funcCode == util.Parity || util.FecGroupLast(index, uf.TotalLen, uf.Fec)) {
+						send <- sack(id, &uf)
+					}
+					dataMap[id] = uf
 				}
 				mapLock.Unlock()
 			default:
@@ -98,50 +374,195 @@ func Upload(storagePath string, recv, send chan util.IMessage, ctx context.Conte
 
 }
 
-func generateId(dataMap map[uint16]util.UploadFile, lock sync.RWMutex) (uint16, bool) {
-	if len(dataMap) >= math.MaxUint16 {
-		return 0, false
-	}
-	var id uint16
-	id = uint16(rand.Intn(math.MaxUint16))
+// generateId : a random id no session has, nobody can guess it to get at the session of someone
+// else; false if there are too many sessions
+func generateId(dataMap map[uint64]util.UploadFile, lock *sync.RWMutex) (uint64, bool) {
 	lock.RLock()
 	defer lock.RUnlock()
+	if len(dataMap) >= util.MaxSessions {
+		return 0, false
+	}
 	for {
-		_, exist := dataMap[id]
-		if !exist {
+		id := util.SessionId()
+		if _, exist := dataMap[id]; !exist {
 			return id, true
 		}
-		id++
 	}
-	return id, true
 }
 
-func storage(path string, uploadFile util.UploadFile) {
-	path = strings.TrimRight(path, string(os.PathSeparator))
-	path = path + string(os.PathSeparator) + uploadFile.Filename
+// createFile : create the file chunks are written into, pre-sized to the declared size
+func createFile(store util.Storage, name string, size int64) (util.File, error) {
 	try := 0
-	var data []byte
-	for _, bytes := range uploadFile.Data {
-		data = append(data, bytes...)
-	}
+	var err error
 	for try < util.MaxStorageTry {
 		try++
-		f, err := os.Create(path)
+		var f util.File
+		f, err = store.Create(name)
 		if err != nil {
-			log.Printf("Failed to store %s %dth time", uploadFile.Filename, try)
 			continue
 		}
-		n, err := f.Write(data)
-		f.Close()
-		if err != nil || n != len(data) {
-			log.Printf("Failed to store %s %dth time", uploadFile.Filename, try)
+		err = f.Truncate(size)
+		if err != nil {
+			f.Close()
 			continue
 		}
-		break
+		return f, nil
+	}
+	return nil, err
+}
+
+// commit : the end of an upload whose chunks all arrived, kept a while after the file is stored
+// so a client whose answer got lost can ask again
+type commit struct {
+	name string
+	addr *net.UDPAddr
+	// the SACK of all chunks, answered to chunks sent again while the file is stored
+	ack []byte
+	// util.Busy while storing, then the code the client is answered with
+	code byte
+	// when the file was stored, or failed to
+	time time.Time
+}
+
+// commitMessage : the end of the upload of session id, code tells how it went
+func commitMessage(id uint64, code byte) []byte {
+	data := make([]byte, util.MessHeadLen)
+	data[0] = util.UploadFlag | code
+	binary.BigEndian.PutUint64(data[util.MessIdIndex:util.MessIdIndex+8], id)
+	return data
+}
+
+// storage : verify the digest of a complete upload and move it into place, counted for its user,
+// then record in commits how that ended and tell the client
+func storage(store util.Storage, id uint64, uploadFile util.UploadFile, quota *util.Quota,
+	commits map[uint64]commit, lock *sync.RWMutex, send chan util.IMessage) {
+	finish := func(code byte) {
+		lock.Lock()
+		c := commits[id]
+		c.code = code
+		c.time = time.Now()
+		commits[id] = c
+		lock.Unlock()
+		send <- util.IMessage{
+			Addr: uploadFile.Addr,
+			Data: commitMessage(id, code),
+		}
+	}
+	if uploadFile.Corrupt > 0 {
+		log.Printf("dropped %d corrupt chunks of %s", uploadFile.Corrupt, uploadFile.Filename)
+	}
+	part := partPath(uploadFile.Filename)
+	// verify what actually reached the disk
+	_, err := uploadFile.File.Seek(0, io.SeekStart)
+	var digest []byte
+	if err == nil {
+		digest, err = util.FileDigest(uploadFile.File)
+	}
+	if err == nil && !bytes.Equal(digest, uploadFile.Digest) {
+		log.Printf("digest of %s does not match, drop it", uploadFile.Filename)
+		uploadFile.File.Close()
+		removePart(store, part)
+		quota.Release(uploadFile.User, uploadFile.Size)
+		finish(util.DigestMismatch)
+		return
+	}
+	if err == nil && util.Exists(store, uploadFile.Filename) {
+		err = os.ErrExist
+	}
+	if err == nil {
+		// only a flushed file is renamed into place, and only then is the sender told
+		err = uploadFile.File.Sync()
+	}
+	if closeErr := uploadFile.File.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = store.Rename(part, uploadFile.Filename)
+	}
+	if err != nil {
+		log.Printf("Failed to store %s：%s", uploadFile.Filename, err.Error())
+		removePart(store, part)
+		quota.Release(uploadFile.User, uploadFile.Size)
+		finish(util.UploadCommitFailed)
+		return
+	}
+	store.Delete(statePath(part))
+	if err := quota.Commit(uploadFile.User, uploadFile.Filename, uploadFile.Size); err != nil {
+		log.Printf("record usage of %s error：%s", uploadFile.Filename, err.Error())
+	}
+	finish(util.UploadCommitted)
+}
+
+// put : write a chunk to the part file and count it as received
+func put(uploadFile *util.UploadFile, index uint32, chunk []byte) error {
+	_, err := uploadFile.File.WriteAt(chunk, int64(index)*int64(uploadFile.ChunkSize))
+	if err != nil {
+		return err
+	}
+	uploadFile.Received.Set(index)
+	uploadFile.CurrLen++
+	uploadFile.Unacked++
+	return nil
+}
+
+// sack : the SACK of what uploadFile received so far
+func sack(id uint64, uploadFile *util.UploadFile) util.IMessage {
+	uploadFile.Low = uploadFile.Received.FirstClear(uploadFile.Low)
+	uploadFile.Unacked = 0
+	data := util.SackMessage(uploadFile.Received, uploadFile.Low)
+	data[0] = util.UploadFlag | util.Sack
+	binary.BigEndian.PutUint64(data[util.MessIdIndex:util.MessIdIndex+8], id)
+	return util.IMessage{
+		Addr: uploadFile.Addr,
+		Data: data,
+	}
+}
+
+// initAck : fill the init message in data as the init ack of session id
+func initAck(data []byte, id uint64, uploadFile util.UploadFile, uploadWindow uint16) []byte {
+	binary.BigEndian.PutUint64(data[util.MessIdIndex:util.MessIdIndex+8], id)
+	// the client splits the file into chunks of the size agreed on
+	binary.BigEndian.PutUint16(data[util.InitChunkIndex:util.InitChunkIndex+2], uint16(uploadFile.ChunkSize))
+	binary.BigEndian.PutUint32(data[util.MessLenIndex:util.MessLenIndex+4], uploadFile.TotalLen)
+	// the client keeps no more chunks in flight than both sides allow
+	if w := binary.BigEndian.Uint16(data[util.InitWindowIndex : util.InitWindowIndex+2]); w == 0 || w > uploadWindow {
+		binary.BigEndian.PutUint16(data[util.InitWindowIndex:util.InitWindowIndex+2], uploadWindow)
+	}
+	data[util.InitFlagIndex] = 0
+	if uploadFile.CurrLen > 0 {
+		data[util.InitFlagIndex] |= util.InitResume
+	}
+	data[0] = util.InitAck | util.UploadFlag
+	return data[:util.InitHeadLen]
+}
+
+// findSession : the session uploading fileName
+func findSession(dataMap map[uint64]util.UploadFile, lock *sync.RWMutex, fileName string) (uint64, bool) {
+	lock.RLock()
+	defer lock.RUnlock()
+	for id, file := range dataMap {
+		if file.Filename == fileName {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// storing : whether the upload of a file named fileName is being stored
+func storing(commits map[uint64]commit, lock *sync.RWMutex, fileName string) bool {
+	lock.RLock()
+	defer lock.RUnlock()
+	for _, c := range commits {
+		if c.name == fileName && c.code == util.Busy {
+			return true
+		}
 	}
+	return false
 }
 
-func cleanData(dataMap map[uint16]util.UploadFile, send chan util.IMessage, lock sync.RWMutex, ctx context.Context) {
+func cleanData(store util.Storage, dataMap map[uint64]util.UploadFile, commits map[uint64]commit, limiter *util.Limiter, quota *util.Quota,
+	send chan util.IMessage, lock *sync.RWMutex, ctx context.Context) {
+	parts := listParts(store)
 	for {
 		time.Sleep(util.CleanTime)
 		select {
@@ -151,7 +572,7 @@ func cleanData(dataMap map[uint16]util.UploadFile, send chan util.IMessage, lock
 		}
 		lock.Lock()
 		//  remove ids
-		var ids []uint16
+		var ids []uint64
 		// uncompleted
 		var uncompleted []util.UploadFile
 		now := time.Now()
@@ -166,9 +587,26 @@ func cleanData(dataMap map[uint16]util.UploadFile, send chan util.IMessage, lock
 		}
 		for _, id := range ids {
 			// remove all the expired data
+			limiter.Release(dataMap[id].Reserved)
+			quota.Release(dataMap[id].User, dataMap[id].Size)
 			delete(dataMap, id)
 		}
+		for id, c := range commits {
+			// the client had time enough to learn how the upload ended
+			if c.code != util.Busy && c.time.Add(util.CommitKeepTime).Before(now) {
+				delete(commits, id)
+			}
+		}
 		for _, file := range uncompleted {
+			if file.Corrupt > 0 {
+				log.Printf("dropped %d corrupt chunks of %s", file.Corrupt, file.Filename)
+			}
+			// keep the part file, the client may come back and resume it
+			err := saveState(store, &file)
+			if err != nil {
+				log.Printf("save state of %s error：%s", file.Filename, err.Error())
+			}
+			file.File.Close()
 			// send fail mess
 			data := make([]byte, util.MessHeadLen)
 			data[0] = util.UploadFlag | util.UploadFail
@@ -178,19 +616,11 @@ func cleanData(dataMap map[uint16]util.UploadFile, send chan util.IMessage, lock
 			}
 			send <- mess
 		}
+		active := make(map[string]struct{}, len(dataMap))
+		for _, file := range dataMap {
+			active[partPath(file.Filename)] = struct{}{}
+		}
 		lock.Unlock()
+		cleanParts(store, parts, active)
 	}
 }
-
-func pathExists(path string) bool {
-	_, err := os.Stat(path)
-	if err == nil {
-		return true
-	}
-	return false
-}
-
-func fileExists(path, fileName string) bool {
-	path = strings.TrimRight(path, string(os.PathSeparator))
-	return pathExists(path + string(os.PathSeparator) + fileName)
-}
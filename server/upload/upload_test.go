@@ -0,0 +1,372 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"server/util"
+	"testing"
+	"time"
+)
+
+const chunkSize = 512
+
+var client = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000}
+
+// content : a file of size bytes, random in the first half and compressible in the second
+func content(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data[:size/2])
+	return data
+}
+
+func initMessage(fileName string, data []byte, fec uint8, caps uint16) []byte {
+	size := int64(len(data))
+	totalLen, _ := util.ChunkCount(size, chunkSize)
+	digest, _ := util.FileDigest(bytes.NewReader(data))
+	initData := make([]byte, util.InitHeadLen)
+	initData[0] = util.UploadFlag | util.Init
+	binary.BigEndian.PutUint32(initData[util.MessLenIndex:util.MessLenIndex+4], totalLen)
+	initData[util.InitVersionIndex] = util.ProtoVersion
+	binary.BigEndian.PutUint64(initData[util.InitSizeIndex:util.InitSizeIndex+8], uint64(size))
+	copy(initData[util.InitDigestIndex:util.InitDigestIndex+util.DigestLen], digest)
+	initData[util.InitFlagIndex] = util.InitResume
+	binary.BigEndian.PutUint16(initData[util.InitWindowIndex:util.InitWindowIndex+2], util.DefaultWindow)
+	initData[util.InitFecIndex] = fec
+	binary.BigEndian.PutUint16(initData[util.InitCapIndex:util.InitCapIndex+2], caps)
+	binary.BigEndian.PutUint16(initData[util.InitChunkIndex:util.InitChunkIndex+2], chunkSize)
+	return append(initData, []byte(fileName)...)
+}
+
+// expect : the next message sent with function code, others in between are skipped
+func expect(t *testing.T, send chan util.IMessage, code byte) []byte {
+	t.Helper()
+	timeout := time.After(time.Second * 5)
+	for {
+		select {
+		case mess := <-send:
+			if mess.Data[0]&0x7f == code {
+				return mess.Data
+			}
+		case <-timeout:
+			t.Fatalf("no message %d", code)
+			return nil
+		}
+	}
+}
+
+func start(t *testing.T, store util.Storage, limiter *util.Limiter) (chan util.IMessage, chan util.IMessage) {
+	quota, err := util.LoadQuota(store, "", 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recv := make(chan util.IMessage)
+	send := make(chan util.IMessage, 4096)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go Upload(store, util.DefaultWindow, util.MaxChunkSize, nil, limiter, quota, recv, send, ctx)
+	return recv, send
+}
+
+// upload : send the chunks of data but those in lost, and a parity after every group of fec;
+// the session id
+func upload(t *testing.T, recv, send chan util.IMessage, fileName string, data []byte, fec uint8, compress bool, lost map[uint32]bool) uint64 {
+	t.Helper()
+	var caps uint16
+	if compress {
+		caps = util.CapCompress
+	}
+	recv <- util.IMessage{Addr: client, Data: initMessage(fileName, data, fec, caps)}
+	ack := expect(t, send, util.InitAck)
+	id := binary.BigEndian.Uint64(ack[util.MessIdIndex : util.MessIdIndex+8])
+	size := int64(len(data))
+	totalLen, _ := util.ChunkCount(size, chunkSize)
+	compressor := util.NewCompressor()
+	for index := uint32(0); index < totalLen; index++ {
+		chunk, err := util.ReadChunk(bytes.NewReader(data), size, chunkSize, index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunk[0] = util.UploadFlag | util.Normal
+		if compress {
+			if compressed, ok := compressor.Compress(chunk); ok {
+				chunk = compressed
+				chunk[0] = util.UploadFlag | util.Compressed
+			}
+		}
+		binary.BigEndian.PutUint64(chunk[util.MessIdIndex:util.MessIdIndex+8], id)
+		util.PutChecksum(chunk)
+		if index == 1 {
+			// damaged on the way, dropped and sent again
+			damaged := append([]byte(nil), chunk...)
+			damaged[len(damaged)-1] ^= 0xff
+			recv <- util.IMessage{Addr: client, Data: damaged}
+		}
+		if !lost[index] {
+			recv <- util.IMessage{Addr: client, Data: chunk}
+		}
+		if fec > 0 && util.FecGroupLast(index, totalLen, fec) {
+			parity, err := util.ParityMessage(bytes.NewReader(data), size, chunkSize, util.FecGroup(index, fec), fec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parity[0] = util.UploadFlag | util.Parity
+			binary.BigEndian.PutUint64(parity[util.MessIdIndex:util.MessIdIndex+8], id)
+			util.PutChecksum(parity)
+			recv <- util.IMessage{Addr: client, Data: parity}
+		}
+	}
+	return id
+}
+
+// committed : ask how the upload id ended until it did
+func committed(t *testing.T, recv, send chan util.IMessage, id uint64) byte {
+	t.Helper()
+	query := make([]byte, util.MessHeadLen)
+	query[0] = util.UploadFlag | util.UploadCommitted
+	binary.BigEndian.PutUint64(query[util.MessIdIndex:util.MessIdIndex+8], id)
+	timeout := time.After(time.Second * 10)
+	for {
+		recv <- util.IMessage{Addr: client, Data: append([]byte(nil), query...)}
+		select {
+		case mess := <-send:
+			switch code := mess.Data[0] & 0x7f; code {
+			case util.UploadCommitted, util.UploadCommitFailed, util.DigestMismatch:
+				return code
+			}
+		case <-timeout:
+			t.Fatalf("upload %d never ended", id)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestUploadRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		fec      uint8
+		compress bool
+		lost     map[uint32]bool
+	}{
+		{"small", 100, 0, false, nil},
+		{"chunks", chunkSize*20 + 7, 0, false, nil},
+		{"compressed", chunkSize * 20, 0, true, nil},
+		{"parity", chunkSize*19 + 300, 4, false, map[uint32]bool{2: true, 5: true, 19: true}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := util.NewMemoryStorage(0)
+			recv, send := start(t, store, util.NewLimiter(util.Limits{}))
+			data := content(test.size)
+			id := upload(t, recv, send, "dir/f.bin", data, test.fec, test.compress, test.lost)
+			if code := committed(t, recv, send, id); code != util.UploadCommitted {
+				t.Fatalf("upload ended with %d", code)
+			}
+			stored, err := util.ReadFile(store, "dir/f.bin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(stored, data) {
+				t.Errorf("stored file differs")
+			}
+			names, err := store.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(names) != 1 {
+				t.Errorf("storage holds %v, want the file alone", names)
+			}
+
+			// the name is taken now
+			recv <- util.IMessage{Addr: client, Data: initMessage("dir/f.bin", content(50), 0, 0)}
+			expect(t, send, util.FileExist)
+		})
+	}
+}
+
+func TestUploadDigestMismatch(t *testing.T) {
+	store := util.NewMemoryStorage(0)
+	recv, send := start(t, store, util.NewLimiter(util.Limits{}))
+	// a digest that does not match what arrived
+	data := content(chunkSize * 3)
+	initData := initMessage("f.bin", data, 0, 0)
+	initData[util.InitDigestIndex] ^= 0xff
+	recv <- util.IMessage{Addr: client, Data: initData}
+	ack := expect(t, send, util.InitAck)
+	id := binary.BigEndian.Uint64(ack[util.MessIdIndex : util.MessIdIndex+8])
+	for index := uint32(0); index < 3; index++ {
+		chunk, _ := util.ReadChunk(bytes.NewReader(data), int64(len(data)), chunkSize, index)
+		chunk[0] = util.UploadFlag | util.Normal
+		binary.BigEndian.PutUint64(chunk[util.MessIdIndex:util.MessIdIndex+8], id)
+		util.PutChecksum(chunk)
+		recv <- util.IMessage{Addr: client, Data: chunk}
+	}
+	if code := committed(t, recv, send, id); code != util.DigestMismatch {
+		t.Errorf("upload with a wrong digest ended with %d", code)
+	}
+	if util.Exists(store, "f.bin") {
+		t.Errorf("file with a wrong digest stored")
+	}
+}
+
+func TestUploadResume(t *testing.T) {
+	store := util.NewMemoryStorage(0)
+	recv, send := start(t, store, util.NewLimiter(util.Limits{}))
+	data := content(chunkSize * 10)
+	lost := map[uint32]bool{3: true, 4: true, 9: true}
+	upload(t, recv, send, "f.bin", data, 0, false, lost)
+
+	// the init ack was lost, the same address gets the same session with what arrived
+	recv <- util.IMessage{Addr: client, Data: initMessage("f.bin", data, 0, 0)}
+	ack := expect(t, send, util.InitAck)
+	if ack[util.InitFlagIndex]&util.InitResume == 0 {
+		t.Errorf("init ack of a session with chunks lacks the resume flag")
+	}
+	id := binary.BigEndian.Uint64(ack[util.MessIdIndex : util.MessIdIndex+8])
+	for index := range lost {
+		chunk, err := util.ReadChunk(bytes.NewReader(data), int64(len(data)), chunkSize, index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunk[0] = util.UploadFlag | util.Normal
+		binary.BigEndian.PutUint64(chunk[util.MessIdIndex:util.MessIdIndex+8], id)
+		util.PutChecksum(chunk)
+		recv <- util.IMessage{Addr: client, Data: chunk}
+	}
+	if code := committed(t, recv, send, id); code != util.UploadCommitted {
+		t.Fatalf("upload ended with %d", code)
+	}
+	stored, err := util.ReadFile(store, "f.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, data) {
+		t.Errorf("stored file differs")
+	}
+}
+
+func TestUploadBadName(t *testing.T) {
+	store := util.NewMemoryStorage(0)
+	recv, send := start(t, store, util.NewLimiter(util.Limits{}))
+	for _, name := range []string{"../f.bin", "/f.bin", "f.bin" + util.PartSuffix} {
+		recv <- util.IMessage{Addr: client, Data: initMessage(name, content(50), 0, 0)}
+		expect(t, send, util.BadFileName)
+	}
+}
+
+func TestUploadBadChunkSize(t *testing.T) {
+	store := util.NewMemoryStorage(0)
+	recv, send := start(t, store, util.NewLimiter(util.Limits{}))
+	initData := initMessage("f.bin", content(50), 0, 0)
+	binary.BigEndian.PutUint16(initData[util.InitChunkIndex:util.InitChunkIndex+2], util.MinChunkSize-1)
+	recv <- util.IMessage{Addr: client, Data: initData}
+	expect(t, send, util.BadChunkSize)
+}
+
+func TestUploadTakeover(t *testing.T) {
+	store := util.NewMemoryStorage(0)
+	recv, send := start(t, store, util.NewLimiter(util.Limits{}))
+	data := content(chunkSize * 10)
+	upload(t, recv, send, "f.bin", data, 0, false, map[uint32]bool{9: true})
+
+	// the client comes back from another address, only once the first has gone quiet
+	moved := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9001}
+	recv <- util.IMessage{Addr: moved, Data: initMessage("f.bin", data, 0, 0)}
+	busy := expect(t, send, util.Busy)
+	wait := time.Duration(binary.BigEndian.Uint32(busy[util.BusyWaitIndex:util.BusyWaitIndex+4])) * time.Millisecond
+	if wait <= 0 || wait > util.TakeoverTime+time.Millisecond {
+		t.Errorf("told to wait %s for a takeover", wait)
+	}
+}
+
+func TestUploadFecChanged(t *testing.T) {
+	data := content(chunkSize * 10)
+	totalLen, _ := util.ChunkCount(int64(len(data)), chunkSize)
+	tests := []struct {
+		name   string
+		memory int64
+		ok     bool
+	}{
+		{"no room for parities", util.SessionMemory(totalLen, chunkSize, util.DefaultWindow, 0), false},
+		{"room for parities", util.SessionMemory(totalLen, chunkSize, util.DefaultWindow, 4), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := util.NewMemoryStorage(0)
+			recv, send := start(t, store, util.NewLimiter(util.Limits{Memory: test.memory}))
+			upload(t, recv, send, "f.bin", data, 0, false, map[uint32]bool{5: true})
+
+			// the init ack was lost and the client asks again with parities
+			recv <- util.IMessage{Addr: client, Data: initMessage("f.bin", data, 4, 0)}
+			if !test.ok {
+				expect(t, send, util.Busy)
+				return
+			}
+			ack := expect(t, send, util.InitAck)
+			id := binary.BigEndian.Uint64(ack[util.MessIdIndex : util.MessIdIndex+8])
+			// the lost chunk comes back from the parity of its group
+			parity, err := util.ParityMessage(bytes.NewReader(data), int64(len(data)), chunkSize, util.FecGroup(5, 4), 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parity[0] = util.UploadFlag | util.Parity
+			binary.BigEndian.PutUint64(parity[util.MessIdIndex:util.MessIdIndex+8], id)
+			util.PutChecksum(parity)
+			recv <- util.IMessage{Addr: client, Data: parity}
+			if code := committed(t, recv, send, id); code != util.UploadCommitted {
+				t.Fatalf("upload ended with %d", code)
+			}
+		})
+	}
+}
+
+func TestCleanParts(t *testing.T) {
+	root := t.TempDir()
+	store := util.NewLocalStorage(root)
+	old := time.Now().Add(-util.PartKeepTime - time.Hour)
+	for _, name := range []string{"f.bin", "old.bin.part", "old.bin.part.state", "dir/new.bin.part", "active.bin.part"} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if name != "dir/new.bin.part" {
+			if err := os.Chtimes(path, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	parts := listParts(store)
+	if len(parts) != 3 {
+		t.Errorf("part files listed: %v", parts)
+	}
+	active := map[string]struct{}{"active.bin.part": {}}
+	cleanParts(store, parts, active)
+	for name, exist := range map[string]bool{
+		"f.bin":              true,
+		"old.bin.part":       false,
+		"old.bin.part.state": false,
+		"dir/new.bin.part":   true,
+		"active.bin.part":    true,
+	} {
+		if util.Exists(store, name) != exist {
+			t.Errorf("%s exists: %v, want %v", name, !exist, exist)
+		}
+	}
+	if _, exist := parts["old.bin.part"]; exist {
+		t.Errorf("removed part file still looked at")
+	}
+
+	// a part file of a session that is over is still looked at, it left the active ones
+	cleanParts(store, parts, nil)
+	if util.Exists(store, "active.bin.part") {
+		t.Errorf("part file of a session that is over kept")
+	}
+}
@@ -0,0 +1,122 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// permissions an ACL grants on files
+const (
+	PermRead = 1 << iota
+	PermWrite
+	PermDelete
+)
+
+type aclRule struct {
+	// a user, @ and a group, or * for everyone
+	who    string
+	perm   int
+	prefix string
+}
+
+// ACL : who may read, write or delete which files under the storage path. Lines of the config are
+//
+//	group <name> <user>...
+//	<user|@group|*> <any of rwd> <path prefix>
+//
+// a prefix covers the file of that name and all files below it, / covers all. Rules only grant,
+// a user has every permission some rule matching it grants on a file
+type ACL struct {
+	groups map[string]map[string]bool
+	rules  []aclRule
+}
+
+// LoadACL : the ACL in the config file at path
+func LoadACL(file string) (*ACL, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	acl := &ACL{groups: make(map[string]map[string]bool)}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if fields[0] == "group" {
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("line %d: group without a name", line)
+			}
+			members := acl.groups[fields[1]]
+			if members == nil {
+				members = make(map[string]bool)
+				acl.groups[fields[1]] = members
+			}
+			for _, user := range fields[2:] {
+				members[user] = true
+			}
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: want who, permissions and a path prefix", line)
+		}
+		perm := 0
+		for _, c := range fields[1] {
+			switch c {
+			case 'r':
+				perm |= PermRead
+			case 'w':
+				perm |= PermWrite
+			case 'd':
+				perm |= PermDelete
+			case '-':
+			default:
+				return nil, fmt.Errorf("line %d: unknown permission %c", line, c)
+			}
+		}
+		acl.rules = append(acl.rules, aclRule{
+			who:    fields[0],
+			perm:   perm,
+			prefix: cleanName(fields[2]),
+		})
+	}
+	return acl, scanner.Err()
+}
+
+// Allowed : whether user may do perm to the file name, everyone may do anything without an ACL
+func (a *ACL) Allowed(user, name string, perm int) bool {
+	if a == nil {
+		return true
+	}
+	name = cleanName(name)
+	for _, rule := range a.rules {
+		if rule.perm&perm != perm || !a.matches(rule.who, user) {
+			continue
+		}
+		if rule.prefix == "/" || name == rule.prefix || strings.HasPrefix(name, rule.prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *ACL) matches(who, user string) bool {
+	switch {
+	case who == "*":
+		return true
+	case strings.HasPrefix(who, "@"):
+		return a.groups[who[1:]][user]
+	default:
+		return who == user
+	}
+}
+
+// cleanName : name as a clean path from the storage path on, starting with /
+func cleanName(name string) string {
+	return path.Clean("/" + strings.ReplaceAll(name, "\\", "/"))
+}
@@ -0,0 +1,76 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestACLAllowed(t *testing.T) {
+	config := `# shared files
+group staff alice bob
+group staff carol
+* r /pub
+@staff rw /shared
+alice rwd /home/alice
+dave - /
+root rwd /
+`
+	path := filepath.Join(t.TempDir(), "acl.txt")
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	acl, err := LoadACL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		user string
+		name string
+		perm int
+		want bool
+	}{
+		{"eve", "pub/a.txt", PermRead, true},
+		{"eve", "pub", PermRead, true},
+		{"eve", "pub/a.txt", PermWrite, false},
+		{"eve", "public/a.txt", PermRead, false},
+		{"", "pub/a.txt", PermRead, true},
+		{"carol", "shared/a.txt", PermWrite, true},
+		{"carol", "shared/a.txt", PermRead | PermWrite, true},
+		{"carol", "shared/a.txt", PermDelete, false},
+		{"eve", "shared/a.txt", PermRead, false},
+		{"alice", "home/alice/a.txt", PermDelete, true},
+		{"bob", "home/alice/a.txt", PermRead, false},
+		{"alice", "home/alice/../bob/a.txt", PermRead, false},
+		{"alice", "home\\alice\\a.txt", PermWrite, true},
+		{"dave", "a.txt", PermRead, false},
+		{"dave", "pub/a.txt", PermRead, true},
+		{"root", "any/where.txt", PermRead | PermWrite | PermDelete, true},
+	}
+	for _, test := range tests {
+		if got := acl.Allowed(test.user, test.name, test.perm); got != test.want {
+			t.Errorf("Allowed(%q, %q, %d) = %v, want %v", test.user, test.name, test.perm, got, test.want)
+		}
+	}
+
+	var none *ACL
+	if !none.Allowed("eve", "a.txt", PermRead|PermWrite|PermDelete) {
+		t.Errorf("no ACL denies")
+	}
+}
+
+func TestLoadACLErrors(t *testing.T) {
+	for _, config := range []string{
+		"group\n",
+		"alice rw\n",
+		"alice rx /\n",
+	} {
+		path := filepath.Join(t.TempDir(), "acl.txt")
+		if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadACL(path); err == nil {
+			t.Errorf("LoadACL(%q) took it", config)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package util
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// UserToken : the token user proves itself with, derived from its password. Whoever holds
+// the token can act as user as well as with the password, tokens are kept as secret
+func UserToken(user, password string) []byte {
+	return derive([]byte(password), []byte("user "+user))
+}
+
+// InitUser : name of the user the init message in data is sent on behalf of
+func InitUser(data []byte) string {
+	return string(data[InitHeadLen : InitHeadLen+int(data[InitUserLenIndex])])
+}
+
+// InitFileName : name of the file the init message in data is about
+func InitFileName(data []byte) string {
+	return string(data[InitHeadLen+int(data[InitUserLenIndex]):])
+}
+
+// initProof : HMAC-SHA256 with token over the init message in data, leaving out the
+// capabilities and salts the way may change and the proof itself. The cookie is signed,
+// a proof is only good from the address the server sent the cookie to
+func initProof(data, token []byte) []byte {
+	mac := hmac.New(sha256.New, token)
+	mac.Write(data[:InitCapIndex])
+	mac.Write(make([]byte, InitCookieIndex-InitCapIndex))
+	mac.Write(data[InitCookieIndex:])
+	return mac.Sum(nil)
+}
+
+// Users : tokens of the users allowed in, by name
+type Users map[string][]byte
+
+// LoadUsers : the users in the credentials file at path, one line of name and base64 token each
+func LoadUsers(path string) (Users, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := make(Users)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: want a name and a token", line)
+		}
+		token, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err.Error())
+		}
+		users[fields[0]] = token
+	}
+	return users, scanner.Err()
+}
+
+// AddUser : append user with the token of password to the credentials file at path
+func AddUser(path, user, password string) error {
+	if user == "" || strings.ContainsAny(user, " \t\n") || len(user) > MaxUserLen {
+		return errors.New("bad user name")
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%s %s\n", user, base64.StdEncoding.EncodeToString(UserToken(user, password)))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Verify : the user the init message in data proves to come from, false if the user is unknown,
+// the proof is wrong or the message is too old or too new to be fresh at now
+func (u Users) Verify(data []byte, now time.Time) (string, bool) {
+	user := InitUser(data)
+	token, ok := u[user]
+	if !ok {
+		return "", false
+	}
+	sent := time.Unix(int64(binary.BigEndian.Uint64(data[InitTimeIndex:InitTimeIndex+8])), 0)
+	if now.Sub(sent) > AuthSkew || sent.Sub(now) > AuthSkew {
+		return "", false
+	}
+	if !hmac.Equal(initProof(data, token), data[InitProofIndex:InitProofIndex+ProofLen]) {
+		return "", false
+	}
+	return user, true
+}
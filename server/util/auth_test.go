@@ -0,0 +1,64 @@
+package util
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// signedInit : an init of user for fileName sent at sent, signed with token
+func signedInit(user, fileName string, token []byte, sent time.Time) []byte {
+	data := make([]byte, InitHeadLen)
+	data[0] = UploadFlag | Init
+	data[InitUserLenIndex] = uint8(len(user))
+	data = append(data, []byte(user+fileName)...)
+	binary.BigEndian.PutUint64(data[InitTimeIndex:InitTimeIndex+8], uint64(sent.Unix()))
+	copy(data[InitProofIndex:InitProofIndex+ProofLen], initProof(data, token))
+	return data
+}
+
+func TestUsersVerify(t *testing.T) {
+	now := time.Now()
+	users := Users{"alice": UserToken("alice", "secret")}
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"signed", signedInit("alice", "f.bin", UserToken("alice", "secret"), now), true},
+		{"wrong password", signedInit("alice", "f.bin", UserToken("alice", "guess"), now), false},
+		{"unknown user", signedInit("bob", "f.bin", UserToken("bob", "secret"), now), false},
+		{"stale", signedInit("alice", "f.bin", UserToken("alice", "secret"), now.Add(-AuthSkew-time.Second)), false},
+		{"from the future", signedInit("alice", "f.bin", UserToken("alice", "secret"), now.Add(AuthSkew+time.Second)), false},
+		{"skewed", signedInit("alice", "f.bin", UserToken("alice", "secret"), now.Add(-AuthSkew+time.Second)), true},
+	}
+	for _, test := range tests {
+		user, ok := users.Verify(test.data, now)
+		if ok != test.ok || ok && user != "alice" {
+			t.Errorf("%s: Verify = %q, %v, want %v", test.name, user, ok, test.ok)
+		}
+	}
+
+	changes := []struct {
+		name   string
+		change func(data []byte)
+		ok     bool
+	}{
+		// the way may change capabilities and salts, they are not signed
+		{"capabilities", func(data []byte) { data[InitCapIndex+1] ^= CapEncrypt }, true},
+		{"salt", func(data []byte) { data[InitSaltIndex] ^= 1 }, true},
+		{"file name", func(data []byte) { data[len(data)-1] ^= 1 }, false},
+		{"size", func(data []byte) { data[InitSizeIndex] ^= 1 }, false},
+		{"proof", func(data []byte) { data[InitProofIndex] ^= 1 }, false},
+		// a proof seen on the way, replayed with the cookie of another address
+		{"cookie", func(data []byte) { data[InitCookieIndex] ^= 1 }, false},
+		{"time", func(data []byte) { data[InitTimeIndex+7] ^= 1 }, false},
+	}
+	for _, test := range changes {
+		data := signedInit("alice", "f.bin", UserToken("alice", "secret"), now)
+		test.change(data)
+		if _, ok := users.Verify(data, now); ok != test.ok {
+			t.Errorf("%s changed: Verify = %v, want %v", test.name, ok, test.ok)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package util
+
+import (
+	"bytes"
+	"compress/flate"
+	"testing"
+)
+
+func TestDecompressor(t *testing.T) {
+	compressor := NewCompressor()
+	decompressor := NewDecompressor()
+	for _, chunk := range [][]byte{
+		bytes.Repeat([]byte("chunk "), 170),
+		bytes.Repeat([]byte{0}, 1024),
+	} {
+		data := append(make([]byte, NormalHeadLen), chunk...)
+		data[MessLenIndex] = 7
+		compressed, ok := compressor.Compress(data)
+		if !ok {
+			t.Fatalf("%d bytes did not compress", len(chunk))
+		}
+		if !bytes.Equal(compressed[:NormalHeadLen], data[:NormalHeadLen]) {
+			t.Errorf("head not kept")
+		}
+		got, err := decompressor.Decompress(compressed, len(chunk))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, chunk) {
+			t.Errorf("chunk of %d bytes inflated wrong", len(chunk))
+		}
+		// a chunk has the length its index gives, shorter or longer is refused
+		if _, err := decompressor.Decompress(compressed, len(chunk)+1); err == nil {
+			t.Errorf("inflated short of the chunk length")
+		}
+		if _, err := decompressor.Decompress(compressed, len(chunk)-1); err == nil {
+			t.Errorf("inflated beyond the chunk length")
+		}
+	}
+
+	// a bomb stops at the chunk length
+	var bomb bytes.Buffer
+	bomb.Write(make([]byte, NormalHeadLen))
+	w, _ := flate.NewWriter(&bomb, flate.BestCompression)
+	w.Write(make([]byte, 1<<24))
+	w.Close()
+	if _, err := decompressor.Decompress(bomb.Bytes(), 1024); err == nil {
+		t.Errorf("a bomb inflated")
+	}
+
+	garbage := append(make([]byte, NormalHeadLen), 0xff, 0xff, 0xff, 0xff)
+	if _, err := decompressor.Decompress(garbage, 1024); err == nil {
+		t.Errorf("garbage inflated")
+	}
+
+	// random data does not get shorter and is sent as it is
+	random := append(make([]byte, NormalHeadLen), []byte{0x8f, 0x13, 0xa2, 0x77, 0x01}...)
+	if out, ok := compressor.Compress(random); ok || !bytes.Equal(out, random) {
+		t.Errorf("incompressible chunk compressed")
+	}
+}
@@ -0,0 +1,144 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+type addrState struct {
+	// proven to receive at the address by a cookie
+	valid bool
+	// bytes that may still be sent to an address not proven
+	credit int
+	used   time.Time
+}
+
+// Validator : keeps the server from being a reflection amplifier. Init and hello must echo a
+// cookie only the address they came from could have received in a retry, and until an address
+// has proven so it gets at most AmplifyFactor times the bytes received from it; safe for
+// concurrent use
+type Validator struct {
+	// key of the cookie MACs, new on every start, a cookie outlives no server
+	secret []byte
+	lock   sync.Mutex
+	addrs  map[string]*addrState
+}
+
+// NewValidator : a validator with a random cookie key
+func NewValidator() *Validator {
+	secret := make([]byte, sha256.Size)
+	rand.Read(secret)
+	return &Validator{
+		secret: secret,
+		addrs:  make(map[string]*addrState),
+	}
+}
+
+// Received : n bytes came from addr
+func (v *Validator) Received(addr *net.UDPAddr, n int) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	s := v.state(addr)
+	if s == nil {
+		return
+	}
+	s.used = time.Now()
+	if !s.valid {
+		s.credit += AmplifyFactor * n
+	}
+}
+
+// Allow : whether n bytes may be sent to addr, taken from its credit unless it is proven
+func (v *Validator) Allow(addr *net.UDPAddr, n int) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	s, ok := v.addrs[addr.String()]
+	if !ok {
+		return false
+	}
+	if s.valid && time.Since(s.used) > ValidTime {
+		// gone quiet, whoever is there now has to prove itself again
+		s.valid = false
+		s.credit = 0
+	}
+	if !s.valid && s.credit < n {
+		return false
+	}
+	if !s.valid {
+		s.credit -= n
+	}
+	return true
+}
+
+// Check : whether cookie, echoed in an init or a hello, was made for addr within CookieTime,
+// which proves addr from now on
+func (v *Validator) Check(addr *net.UDPAddr, cookie []byte) bool {
+	made := time.Unix(int64(binary.BigEndian.Uint64(cookie)), 0)
+	if now := time.Now(); made.After(now) || now.Sub(made) > CookieTime {
+		return false
+	}
+	if !hmac.Equal(cookie[8:], v.mac(addr, cookie[:8])) {
+		return false
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if s := v.state(addr); s != nil {
+		s.valid = true
+		s.used = time.Now()
+	}
+	return true
+}
+
+// Retry : the retry answering the init or hello in data from addr, with a new cookie for addr
+func (v *Validator) Retry(addr *net.UDPAddr, data []byte) []byte {
+	retry := make([]byte, RetryLen)
+	copy(retry, data[:MessHeadLen])
+	retry[0] = data[0]&0x80 | Retry
+	cookie := retry[RetryCookieIndex:]
+	binary.BigEndian.PutUint64(cookie, uint64(time.Now().Unix()))
+	copy(cookie[8:], v.mac(addr, cookie[:8]))
+	return retry
+}
+
+func (v *Validator) mac(addr *net.UDPAddr, made []byte) []byte {
+	mac := hmac.New(sha256.New, v.secret)
+	mac.Write([]byte(addr.String()))
+	mac.Write(made)
+	return mac.Sum(nil)[:CookieLen-8]
+}
+
+// state : what is known of addr, addresses unheard of for ValidTime are forgotten to make room,
+// then one not proven; nil if there is still no room
+func (v *Validator) state(addr *net.UDPAddr) *addrState {
+	name := addr.String()
+	if s, ok := v.addrs[name]; ok {
+		return s
+	}
+	if len(v.addrs) >= MaxAddrs {
+		now := time.Now()
+		for other, s := range v.addrs {
+			if now.Sub(s.used) > ValidTime {
+				delete(v.addrs, other)
+			}
+		}
+	}
+	if len(v.addrs) >= MaxAddrs {
+		for other, s := range v.addrs {
+			if !s.valid {
+				delete(v.addrs, other)
+				break
+			}
+		}
+	}
+	if len(v.addrs) >= MaxAddrs {
+		return nil
+	}
+	s := &addrState{}
+	v.addrs[name] = s
+	return s
+}
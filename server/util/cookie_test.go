@@ -0,0 +1,75 @@
+package util
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// cookieAt : a cookie for addr as if made at made
+func cookieAt(v *Validator, addr *net.UDPAddr, made time.Time) []byte {
+	cookie := make([]byte, CookieLen)
+	binary.BigEndian.PutUint64(cookie, uint64(made.Unix()))
+	copy(cookie[8:], v.mac(addr, cookie[:8]))
+	return cookie
+}
+
+func TestValidatorCheck(t *testing.T) {
+	v := NewValidator()
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 9000}
+	hello := make([]byte, HelloLen)
+	hello[0] = UploadFlag | Hello
+	retry := v.Retry(clientAddr, hello)
+	if retry[0] != UploadFlag|Retry || len(retry) != RetryLen {
+		t.Fatalf("retry is %d of %d bytes", retry[0], len(retry))
+	}
+	now := time.Now()
+	tests := []struct {
+		name   string
+		addr   *net.UDPAddr
+		cookie []byte
+		ok     bool
+	}{
+		{"retry", clientAddr, retry[RetryCookieIndex:], true},
+		{"other address", other, retry[RetryCookieIndex:], false},
+		{"other port", &net.UDPAddr{IP: clientAddr.IP, Port: clientAddr.Port + 1}, retry[RetryCookieIndex:], false},
+		{"aged", clientAddr, cookieAt(v, clientAddr, now.Add(-CookieTime+time.Second)), true},
+		{"expired", clientAddr, cookieAt(v, clientAddr, now.Add(-CookieTime-time.Second)), false},
+		{"from the future", clientAddr, cookieAt(v, clientAddr, now.Add(time.Minute)), false},
+		{"of another server", clientAddr, cookieAt(NewValidator(), clientAddr, now), false},
+		{"none", clientAddr, make([]byte, CookieLen), false},
+	}
+	for _, test := range tests {
+		if ok := v.Check(test.addr, test.cookie); ok != test.ok {
+			t.Errorf("%s: Check = %v, want %v", test.name, ok, test.ok)
+		}
+	}
+
+	// a changed time is caught by the MAC
+	cookie := append([]byte(nil), retry[RetryCookieIndex:]...)
+	cookie[7] ^= 1
+	if v.Check(clientAddr, cookie) {
+		t.Errorf("cookie with a changed time taken")
+	}
+}
+
+func TestValidatorAllow(t *testing.T) {
+	v := NewValidator()
+	if v.Allow(clientAddr, 1) {
+		t.Errorf("bytes allowed to an address never heard of")
+	}
+	v.Received(clientAddr, 100)
+	if !v.Allow(clientAddr, AmplifyFactor*100) {
+		t.Errorf("credit of an address not proven not allowed")
+	}
+	if v.Allow(clientAddr, 1) {
+		t.Errorf("more than the credit allowed to an address not proven")
+	}
+	if !v.Check(clientAddr, cookieAt(v, clientAddr, time.Now())) {
+		t.Fatal("cookie not taken")
+	}
+	if !v.Allow(clientAddr, AmplifyFactor*1000) {
+		t.Errorf("bytes not allowed to a proven address")
+	}
+}
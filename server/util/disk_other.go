@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package util
+
+// freeSpace : not supported here, the free space is not checked
+func freeSpace(path string) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,15 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package util
+
+import "syscall"
+
+// freeSpace : bytes free for an unprivileged user on the file system of path, false if unknown
+func freeSpace(path string) (int64, bool) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, false
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), true
+}
@@ -0,0 +1,110 @@
+package util
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"net"
+)
+
+// helloLabel : signed along with both ephemeral keys, so the signature is good for nothing else
+const helloLabel = "udp file hello"
+
+// Exchange : ephemeral X25519 key exchange started by a client. The server signs both ephemeral
+// keys with its static host key, the client checks the host key against the one it pinned. Both
+// ephemeral keys are dropped once the secret is agreed, a leaked host key reveals no secret
+type Exchange struct {
+	priv *ecdh.PrivateKey
+}
+
+// NewExchange : a key exchange and the hello message starting it, flag is the direction
+// its answer comes back in
+func NewExchange(flag uint8) (*Exchange, []byte, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	// padded to the length of the answer, a hello makes the server send no more than it got
+	hello := make([]byte, HelloLen)
+	hello[0] = flag | Hello
+	copy(hello[HelloKeyIndex:HelloKeyIndex+HelloKeyLen], priv.PublicKey().Bytes())
+	return &Exchange{priv: priv}, hello, nil
+}
+
+// Finish : the host key of the server and the secret agreed, from the hello ack in data
+func (e *Exchange) Finish(data []byte) (ed25519.PublicKey, []byte, error) {
+	if len(data) != HelloLen {
+		return nil, nil, errors.New("bad hello ack")
+	}
+	serverPub, err := ecdh.X25519().NewPublicKey(data[HelloKeyIndex : HelloKeyIndex+HelloKeyLen])
+	if err != nil {
+		return nil, nil, err
+	}
+	host := ed25519.PublicKey(append([]byte(nil), data[HelloHostIndex:HelloHostIndex+ed25519.PublicKeySize]...))
+	transcript := helloTranscript(e.priv.PublicKey().Bytes(), serverPub.Bytes(), host)
+	if !ed25519.Verify(host, transcript, data[HelloSigIndex:HelloSigIndex+ed25519.SignatureSize]) {
+		return nil, nil, errors.New("bad host signature")
+	}
+	shared, err := e.priv.ECDH(serverPub)
+	if err != nil {
+		return nil, nil, err
+	}
+	e.priv = nil
+	return host, exchangeSecret(shared, transcript), nil
+}
+
+// SetHostKey : answer hellos, signing them with hostKey
+func (k *Keyring) SetHostKey(hostKey ed25519.PrivateKey) {
+	k.hostKey = hostKey
+}
+
+// Hello : the hello ack answering the hello in data from addr, whose secret seals what is
+// exchanged with addr once addr sealed a message with it; false if this side has no host key,
+// the hello is bad or too many hellos await their init
+func (k *Keyring) Hello(addr *net.UDPAddr, data []byte) ([]byte, bool) {
+	if k.hostKey == nil || len(data) != HelloLen || !k.hasRoom(addr) {
+		return nil, false
+	}
+	clientPub, err := ecdh.X25519().NewPublicKey(data[HelloKeyIndex : HelloKeyIndex+HelloKeyLen])
+	if err != nil {
+		return nil, false
+	}
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, false
+	}
+	shared, err := priv.ECDH(clientPub)
+	if err != nil {
+		// a low order point from the client
+		return nil, false
+	}
+	host := k.hostKey.Public().(ed25519.PublicKey)
+	transcript := helloTranscript(clientPub.Bytes(), priv.PublicKey().Bytes(), host)
+	ack := make([]byte, HelloLen)
+	copy(ack, data[:MessHeadLen])
+	ack[0] = data[0]&0x80 | HelloAck
+	copy(ack[HelloKeyIndex:HelloKeyIndex+HelloKeyLen], priv.PublicKey().Bytes())
+	copy(ack[HelloHostIndex:HelloHostIndex+ed25519.PublicKeySize], host)
+	copy(ack[HelloSigIndex:HelloSigIndex+ed25519.SignatureSize], ed25519.Sign(k.hostKey, transcript))
+	if !k.offer(addr, exchangeSecret(shared, transcript)) {
+		return nil, false
+	}
+	return ack, true
+}
+
+func helloTranscript(clientPub, serverPub, host []byte) []byte {
+	var transcript bytes.Buffer
+	transcript.WriteString(helloLabel)
+	transcript.Write(clientPub)
+	transcript.Write(serverPub)
+	transcript.Write(host)
+	return transcript.Bytes()
+}
+
+func exchangeSecret(shared, transcript []byte) []byte {
+	sum := sha256.Sum256(transcript)
+	return derive(shared, sum[:])
+}
@@ -0,0 +1,109 @@
+package util
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+)
+
+func hostKeyring(t *testing.T) *Keyring {
+	t.Helper()
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := NewKeyring(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.SetHostKey(hostKey)
+	return k
+}
+
+// sealWith : data sealed with the handshake key of the master agreed in secret
+func sealWith(secret, data []byte) []byte {
+	aead, _ := newAEAD(derive(secret, []byte("handshake")))
+	sealed := make([]byte, MessHeadLen+nonceLen, len(data)+SealOverhead)
+	copy(sealed, data[:MessHeadLen])
+	rand.Read(sealed[MessHeadLen:])
+	return aead.Seal(sealed, sealed[MessHeadLen:], data[MessHeadLen:], data[:MessHeadLen])
+}
+
+func TestExchange(t *testing.T) {
+	server := hostKeyring(t)
+	exchange, hello, err := NewExchange(UploadFlag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack, ok := server.Hello(clientAddr, hello)
+	if !ok {
+		t.Fatal("hello not answered")
+	}
+	host, secret, err := exchange.Finish(ack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !host.Equal(server.hostKey.Public()) {
+		t.Errorf("host key differs")
+	}
+	// the key offered in the hello ack is the key of the client once it seals with it
+	data := chunkMessage(0, 0)
+	if _, ok := server.Open(clientAddr, sealWith(secret, data)); !ok {
+		t.Fatal("message sealed with the agreed secret not opened")
+	}
+
+	// a later hello, say with a forged address, does not replace the key in use
+	_, again, _ := NewExchange(UploadFlag)
+	if _, ok := server.Hello(clientAddr, again); !ok {
+		t.Fatal("second hello not answered")
+	}
+	if _, ok := server.Open(clientAddr, sealWith(secret, data)); !ok {
+		t.Errorf("hello replaced the key in use")
+	}
+}
+
+func TestExchangeRejects(t *testing.T) {
+	server := hostKeyring(t)
+	other := hostKeyring(t)
+	tests := []struct {
+		name string
+		// change : the hello ack as it arrives
+		change func(ack []byte) []byte
+	}{
+		{"signature", func(ack []byte) []byte { ack[HelloSigIndex] ^= 1; return ack }},
+		{"server key", func(ack []byte) []byte { ack[HelloKeyIndex] ^= 1; return ack }},
+		{"host key", func(ack []byte) []byte {
+			copy(ack[HelloHostIndex:HelloHostIndex+ed25519.PublicKeySize], other.hostKey.Public().(ed25519.PublicKey))
+			return ack
+		}},
+		{"short", func(ack []byte) []byte { return ack[:HelloLen-1] }},
+	}
+	for _, test := range tests {
+		exchange, hello, err := NewExchange(UploadFlag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ack, ok := server.Hello(clientAddr, hello)
+		if !ok {
+			t.Fatalf("%s: hello not answered", test.name)
+		}
+		if _, _, err := exchange.Finish(test.change(ack)); err == nil {
+			t.Errorf("%s: changed hello ack taken", test.name)
+		}
+	}
+
+	// hellos the server does not answer
+	_, hello, _ := NewExchange(UploadFlag)
+	if _, ok := server.Hello(clientAddr, hello[:HelloLen-1]); ok {
+		t.Errorf("short hello answered")
+	}
+	lowOrder := append([]byte(nil), hello...)
+	copy(lowOrder[HelloKeyIndex:HelloKeyIndex+HelloKeyLen], make([]byte, HelloKeyLen))
+	if _, ok := server.Hello(clientAddr, lowOrder); ok {
+		t.Errorf("hello with a low order key answered")
+	}
+	noHost, _ := NewKeyring(nil)
+	if _, ok := noHost.Hello(clientAddr, hello); ok {
+		t.Errorf("hello answered without a host key")
+	}
+}
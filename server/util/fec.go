@@ -0,0 +1,120 @@
+package util
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// FecGroup : group of the chunk at index when a parity chunk follows every k chunks
+func FecGroup(index uint32, k uint8) uint32 {
+	return index / uint32(k)
+}
+
+// FecGroupLast : whether index is the last chunk of its group, after which its parity is sent
+func FecGroupLast(index, totalLen uint32, k uint8) bool {
+	return index%uint32(k) == uint32(k)-1 || index == totalLen-1
+}
+
+// fecGroupRange : the chunks of group are [begin, end)
+func fecGroupRange(group, totalLen uint32, k uint8) (uint32, uint32) {
+	begin := group * uint32(k)
+	end := begin + uint32(k)
+	if end > totalLen || end < begin {
+		end = totalLen
+	}
+	return begin, end
+}
+
+// ParityLen : length of the parity of group, that of its first and longest chunk
+func ParityLen(size int64, chunkSize int, group uint32, k uint8) int {
+	return ChunkLen(size, chunkSize, group*uint32(k))
+}
+
+// ParityMessage : the XOR of the chunks of group read from r, as a message laid out like
+// a normal one; the head is left for the caller except the index, which holds the group
+func ParityMessage(r io.ReaderAt, size int64, chunkSize int, group uint32, k uint8) ([]byte, error) {
+	totalLen, _ := ChunkCount(size, chunkSize)
+	begin, end := fecGroupRange(group, totalLen, k)
+	data := make([]byte, NormalHeadLen+ParityLen(size, chunkSize, group, k))
+	for index := begin; index < end; index++ {
+		chunk, err := ReadChunk(r, size, chunkSize, index)
+		if err != nil {
+			return nil, err
+		}
+		xor(data[NormalHeadLen:], chunk[NormalHeadLen:])
+	}
+	binary.BigEndian.PutUint32(data[MessLenIndex:MessLenIndex+4], group)
+	return data, nil
+}
+
+// Parities : parities kept by group until their group lacks exactly one chunk
+type Parities map[uint32][]byte
+
+// ParityKeep : parities a receiver keeps at most, those of the groups of k a window of chunks
+// spans; none without parities
+func ParityKeep(window uint16, k uint8) int {
+	if k == 0 {
+		return 0
+	}
+	return int(window)/int(k) + 2
+}
+
+// Add : keep the parity of group, in place of that of the lowest group if keep are kept already
+func (p Parities) Add(group uint32, parity []byte, keep int) {
+	if _, exist := p[group]; !exist && len(p) >= keep {
+		// the lowest group has waited longest for chunks sent again, its parity is worth least
+		lowest := group
+		for g := range p {
+			if g < lowest {
+				lowest = g
+			}
+		}
+		if lowest == group {
+			return
+		}
+		delete(p, lowest)
+	}
+	p[group] = append([]byte(nil), parity...)
+}
+
+// Recover : rebuild the only chunk group lacks from its parity and the other chunks read from r,
+// false if it lacks none or more than one or there is no parity for it
+func (p Parities) Recover(r io.ReaderAt, size int64, chunkSize int, received Bitmap, group uint32, k uint8) (uint32, []byte, bool) {
+	parity, exist := p[group]
+	if !exist {
+		return 0, nil, false
+	}
+	totalLen, _ := ChunkCount(size, chunkSize)
+	begin, end := fecGroupRange(group, totalLen, k)
+	var missing []uint32
+	for index := begin; index < end; index++ {
+		if !received.Has(index) {
+			missing = append(missing, index)
+		}
+	}
+	if len(missing) == 0 {
+		delete(p, group)
+		return 0, nil, false
+	}
+	if len(missing) > 1 {
+		return 0, nil, false
+	}
+	delete(p, group)
+	for index := begin; index < end; index++ {
+		if index == missing[0] {
+			continue
+		}
+		chunk, err := ReadChunk(r, size, chunkSize, index)
+		if err != nil {
+			return 0, nil, false
+		}
+		xor(parity, chunk[NormalHeadLen:])
+	}
+	return missing[0], parity[:ChunkLen(size, chunkSize, missing[0])], true
+}
+
+func xor(dst, src []byte) {
+	for i := range src {
+		dst[i] ^= src[i]
+	}
+}
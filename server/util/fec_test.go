@@ -0,0 +1,101 @@
+package util
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestParitiesRecover(t *testing.T) {
+	const (
+		chunkSize = 256
+		k         = 4
+	)
+	// the last group is short and so is its last chunk
+	size := int64(chunkSize*10 + 100)
+	content := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(content)
+	totalLen, _ := ChunkCount(size, chunkSize)
+
+	for _, lost := range []uint32{0, 2, 7, 9, 10} {
+		group := FecGroup(lost, k)
+		parity, err := ParityMessage(bytes.NewReader(content), size, chunkSize, group, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the receiver has every chunk but the lost one, which is zero in its file
+		file := append([]byte(nil), content...)
+		begin := int64(lost) * chunkSize
+		copy(file[begin:begin+int64(ChunkLen(size, chunkSize, lost))], make([]byte, chunkSize))
+		received := NewBitmap(totalLen)
+		for index := uint32(0); index < totalLen; index++ {
+			if index != lost {
+				received.Set(index)
+			}
+		}
+		p := make(Parities)
+		p.Add(group, parity[NormalHeadLen:], ParityKeep(64, k))
+		index, chunk, ok := p.Recover(bytes.NewReader(file), size, chunkSize, received, group, k)
+		if !ok || index != lost {
+			t.Errorf("chunk %d: Recover = %d, %v", lost, index, ok)
+			continue
+		}
+		if !bytes.Equal(chunk, content[begin:begin+int64(ChunkLen(size, chunkSize, lost))]) {
+			t.Errorf("chunk %d recovered wrong", lost)
+		}
+		if len(p) != 0 {
+			t.Errorf("chunk %d: parity kept after use", lost)
+		}
+	}
+
+	// two chunks lost from a group are beyond one parity, it is kept for later
+	group := uint32(1)
+	parity, err := ParityMessage(bytes.NewReader(content), size, chunkSize, group, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := NewBitmap(totalLen)
+	for index := uint32(0); index < totalLen; index++ {
+		if index != 4 && index != 5 {
+			received.Set(index)
+		}
+	}
+	p := make(Parities)
+	p.Add(group, parity[NormalHeadLen:], ParityKeep(64, k))
+	if _, _, ok := p.Recover(bytes.NewReader(content), size, chunkSize, received, group, k); ok {
+		t.Errorf("recovered two chunks from one parity")
+	}
+	if len(p) != 1 {
+		t.Errorf("parity dropped while the group lacks two chunks")
+	}
+	received.Set(5)
+	if index, _, ok := p.Recover(bytes.NewReader(content), size, chunkSize, received, group, k); !ok || index != 4 {
+		t.Errorf("Recover once one chunk arrived = %d, %v", index, ok)
+	}
+
+	// nothing to do without a parity
+	if _, _, ok := p.Recover(bytes.NewReader(content), size, chunkSize, received, 2, k); ok {
+		t.Errorf("recovered without a parity")
+	}
+}
+
+func TestParitiesAdd(t *testing.T) {
+	p := make(Parities)
+	for group := uint32(1); group <= 3; group++ {
+		p.Add(group, []byte{byte(group)}, 3)
+	}
+	// full, the lowest group makes room, and a group lower than all is not kept
+	p.Add(4, []byte{4}, 3)
+	p.Add(0, []byte{0}, 3)
+	if len(p) != 3 {
+		t.Fatalf("%d parities kept, want 3", len(p))
+	}
+	for _, group := range []uint32{2, 3, 4} {
+		if _, ok := p[group]; !ok {
+			t.Errorf("parity of group %d dropped", group)
+		}
+	}
+	if ParityKeep(64, 0) != 0 {
+		t.Errorf("parities kept without FEC")
+	}
+}
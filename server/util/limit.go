@@ -0,0 +1,171 @@
+package util
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// Limits : how much the server takes, 0 for no limit
+type Limits struct {
+	// IPPackets, IPBytes : packets and bytes a second from one ip
+	IPPackets float64
+	IPBytes   float64
+	// IPSessions : new sessions a minute from one ip
+	IPSessions float64
+	// Sessions : sessions at the same time
+	Sessions int
+	// Memory : bytes reserved by all sessions, see SessionMemory
+	Memory int64
+}
+
+// bucket : a token bucket
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take : whether n tokens are left of a bucket filled with rate tokens a second up to burst,
+// else how long until they are
+func (b *bucket) take(rate, burst, n float64, now time.Time) (time.Duration, bool) {
+	if rate <= 0 {
+		return 0, true
+	}
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+	if b.tokens >= n {
+		b.tokens -= n
+		return 0, true
+	}
+	return time.Duration((n - b.tokens) / rate * float64(time.Second)), false
+}
+
+type ipState struct {
+	packets  bucket
+	bytes    bucket
+	sessions bucket
+	used     time.Time
+}
+
+// Limiter : token buckets by ip for packets, bytes and new sessions, and the sessions and memory
+// reserved by all of them; safe for concurrent use
+type Limiter struct {
+	limits   Limits
+	lock     sync.Mutex
+	ips      map[string]*ipState
+	sessions int
+	memory   int64
+}
+
+// NewLimiter : a limiter keeping to limits
+func NewLimiter(limits Limits) *Limiter {
+	return &Limiter{
+		limits: limits,
+		ips:    make(map[string]*ipState),
+	}
+}
+
+// Packet : whether a packet of n bytes from addr is within the limits of its ip,
+// else how long until it would be
+func (l *Limiter) Packet(addr *net.UDPAddr, n int) (time.Duration, bool) {
+	now := time.Now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	ip := l.ip(addr, now)
+	// a burst of a second, and at least one of the largest messages
+	wait, ok := ip.packets.take(l.limits.IPPackets, math.Max(l.limits.IPPackets, 1), 1, now)
+	if !ok {
+		return wait, false
+	}
+	return ip.bytes.take(l.limits.IPBytes, math.Max(l.limits.IPBytes, MaxDatagram), float64(n), now)
+}
+
+// NewSession : whether addr may start another session, else how long until it may
+func (l *Limiter) NewSession(addr *net.UDPAddr) (time.Duration, bool) {
+	now := time.Now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	// the sessions of a minute may come at once
+	return l.ip(addr, now).sessions.take(l.limits.IPSessions/60, math.Max(l.limits.IPSessions, 1), 1, now)
+}
+
+// Reserve : whether another session reserving memory bytes fits, counted until it is released
+func (l *Limiter) Reserve(memory int64) (time.Duration, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.limits.Sessions > 0 && l.sessions >= l.limits.Sessions ||
+		l.limits.Memory > 0 && l.memory+memory > l.limits.Memory {
+		// it depends on when other sessions end, a guess
+		return BusyWait, false
+	}
+	l.sessions++
+	l.memory += memory
+	return 0, true
+}
+
+// Resize : whether a session reserving from bytes may reserve to bytes instead, else how long
+// until it may; it always may reserve less
+func (l *Limiter) Resize(from, to int64) (time.Duration, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if to > from && l.limits.Memory > 0 && l.memory-from+to > l.limits.Memory {
+		return BusyWait, false
+	}
+	l.memory += to - from
+	return 0, true
+}
+
+// Release : a session reserving memory bytes ended
+func (l *Limiter) Release(memory int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.sessions--
+	l.memory -= memory
+}
+
+// ip : the buckets of the ip of addr, ips unheard of for a minute are forgotten to make room,
+// then any one
+func (l *Limiter) ip(addr *net.UDPAddr, now time.Time) *ipState {
+	name := addr.IP.String()
+	s, ok := l.ips[name]
+	if !ok {
+		if len(l.ips) >= MaxAddrs {
+			for other, s := range l.ips {
+				if now.Sub(s.used) > time.Minute {
+					delete(l.ips, other)
+				}
+			}
+		}
+		for other := range l.ips {
+			if len(l.ips) < MaxAddrs {
+				break
+			}
+			delete(l.ips, other)
+		}
+		s = &ipState{}
+		l.ips[name] = s
+	}
+	s.used = now
+	return s
+}
+
+// SessionMemory : bytes a session is taken to reserve, the bitmap of its chunks, a window
+// of them on the way and the parities kept for groups of k
+func SessionMemory(totalLen uint32, chunkSize int, window uint16, k uint8) int64 {
+	return int64(totalLen)/8 + 1 + int64(int(window)+ParityKeep(window, k))*int64(chunkSize)
+}
+
+// BusyMessage : busy answering the message in data, asking to try again after wait
+func BusyMessage(data []byte, wait time.Duration) []byte {
+	busy := make([]byte, BusyLen)
+	copy(busy, data[:MessHeadLen])
+	busy[0] = data[0]&0x80 | Busy
+	binary.BigEndian.PutUint32(busy[BusyWaitIndex:], uint32(wait/time.Millisecond)+1)
+	return busy
+}
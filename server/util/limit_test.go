@@ -0,0 +1,119 @@
+package util
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	start := time.Now()
+	var b bucket
+	tests := []struct {
+		name  string
+		after time.Duration
+		n     float64
+		wait  time.Duration
+		ok    bool
+	}{
+		// a new bucket is full
+		{"burst", 0, 10, 0, true},
+		{"empty", 0, 1, 100 * time.Millisecond, false},
+		{"refilled", 200 * time.Millisecond, 2, 0, true},
+		{"short", 200 * time.Millisecond, 3, 300 * time.Millisecond, false},
+		// never more than the burst
+		{"idle", time.Hour, 10, 0, true},
+		{"idle more than the burst", 2 * time.Hour, 11, 100 * time.Millisecond, false},
+	}
+	for _, test := range tests {
+		// 10 tokens a second up to 10
+		wait, ok := b.take(10, 10, test.n, start.Add(test.after))
+		if ok != test.ok || wait.Round(time.Millisecond) != test.wait {
+			t.Errorf("%s: take = %s, %v, want %s, %v", test.name, wait, ok, test.wait, test.ok)
+		}
+	}
+	if _, ok := b.take(0, 0, 1e9, start); !ok {
+		t.Errorf("no rate is no limit")
+	}
+}
+
+func TestLimiterReserve(t *testing.T) {
+	l := NewLimiter(Limits{Sessions: 2, Memory: 100})
+	steps := []struct {
+		name string
+		do   func() (time.Duration, bool)
+		ok   bool
+	}{
+		{"first", func() (time.Duration, bool) { return l.Reserve(60) }, true},
+		{"no memory", func() (time.Duration, bool) { return l.Reserve(50) }, false},
+		{"second", func() (time.Duration, bool) { return l.Reserve(40) }, true},
+		{"no session", func() (time.Duration, bool) { return l.Reserve(0) }, false},
+		{"grow past the memory", func() (time.Duration, bool) { return l.Resize(40, 41) }, false},
+		{"shrink", func() (time.Duration, bool) { return l.Resize(40, 10) }, true},
+		{"grow into the memory freed", func() (time.Duration, bool) { return l.Resize(10, 40) }, true},
+		{"release", func() (time.Duration, bool) { l.Release(60); return 0, true }, true},
+		{"reserved again", func() (time.Duration, bool) { return l.Reserve(60) }, true},
+	}
+	for _, step := range steps {
+		wait, ok := step.do()
+		if ok != step.ok {
+			t.Errorf("%s: %v, want %v", step.name, ok, step.ok)
+		}
+		if !ok && wait != BusyWait {
+			t.Errorf("%s: wait %s, want %s", step.name, wait, BusyWait)
+		}
+	}
+}
+
+func TestLimiterPacket(t *testing.T) {
+	l := NewLimiter(Limits{IPPackets: 2, IPSessions: 60})
+	for n := 0; n < 2; n++ {
+		if _, ok := l.Packet(clientAddr, 100); !ok {
+			t.Errorf("packet %d within the burst refused", n)
+		}
+	}
+	wait, ok := l.Packet(clientAddr, 100)
+	if ok || wait <= 0 || wait > time.Second {
+		t.Errorf("packet past the burst: %s, %v", wait, ok)
+	}
+	// buckets are by ip, another port is no other sender
+	if _, ok := l.Packet(serverAddr, 100); ok {
+		t.Errorf("another port of the ip got its own bucket")
+	}
+	for n := 0; n < 60; n++ {
+		if _, ok := l.NewSession(clientAddr); !ok {
+			t.Fatalf("session %d within the burst refused", n)
+		}
+	}
+	if wait, ok := l.NewSession(clientAddr); ok || wait <= 0 || wait > time.Second {
+		t.Errorf("session past the burst: %s, %v", wait, ok)
+	}
+}
+
+func TestBusyMessage(t *testing.T) {
+	data := make([]byte, MessHeadLen)
+	data[0] = DownloadFlag | Init
+	binary.BigEndian.PutUint64(data[MessIdIndex:MessIdIndex+8], 5)
+	tests := []struct {
+		wait time.Duration
+		ms   uint32
+	}{
+		{0, 1},
+		{time.Millisecond, 2},
+		{1500 * time.Microsecond, 2},
+		{BusyWait, uint32(BusyWait/time.Millisecond) + 1},
+	}
+	for _, test := range tests {
+		busy := BusyMessage(data, test.wait)
+		if len(busy) != BusyLen || busy[0] != DownloadFlag|Busy {
+			t.Errorf("busy of %s is %d of %d bytes", test.wait, busy[0], len(busy))
+		}
+		if id := binary.BigEndian.Uint64(busy[MessIdIndex : MessIdIndex+8]); id != 5 {
+			t.Errorf("busy of id %d", id)
+		}
+		// rounded up, asking again too early would only be refused again
+		if ms := binary.BigEndian.Uint32(busy[BusyWaitIndex:]); ms != test.ms {
+			t.Errorf("busy of %s waits %d ms, want %d", test.wait, ms, test.ms)
+		}
+	}
+}
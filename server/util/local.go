@@ -0,0 +1,100 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LocalStorage : files under a directory of the local disk
+type LocalStorage struct {
+	root string
+}
+
+func NewLocalStorage(root string) *LocalStorage {
+	return &LocalStorage{root: root}
+}
+
+// path : where the file name is on the disk, ErrOutside if symlinks lead it out of the root
+func (l *LocalStorage) path(name string) (string, error) {
+	if !InStorage(l.root, name) {
+		return "", ErrOutside
+	}
+	return StorageFile(l.root, name), nil
+}
+
+func (l *LocalStorage) Stat(name string) (os.FileInfo, error) {
+	path, err := l.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(path)
+}
+
+func (l *LocalStorage) Open(name string, write bool) (File, error) {
+	path, err := l.path(name)
+	if err != nil {
+		return nil, err
+	}
+	flag := os.O_RDONLY
+	if write {
+		flag = os.O_RDWR
+	}
+	return os.OpenFile(path, flag, 0644)
+}
+
+func (l *LocalStorage) Create(name string) (File, error) {
+	path, err := l.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Create(path)
+}
+
+// Rename : the directory is flushed too, the rename survives a crash once it returns
+func (l *LocalStorage) Rename(from, to string) error {
+	fromPath, err := l.path(from)
+	if err != nil {
+		return err
+	}
+	toPath, err := l.path(to)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(fromPath, toPath)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(toPath))
+}
+
+// List : files in the subdirectories too, by their names relative to the root with / between
+// their parts
+func (l *LocalStorage) List() ([]string, error) {
+	var names []string
+	err := filepath.Walk(l.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		name, err := filepath.Rel(l.root, path)
+		if err != nil || name == ".." || strings.HasPrefix(name, ".."+string(os.PathSeparator)) {
+			return nil
+		}
+		names = append(names, filepath.ToSlash(name))
+		return nil
+	})
+	return names, err
+}
+
+// Free : what the file system of the root has free for an unprivileged user
+func (l *LocalStorage) Free() (int64, bool) {
+	return freeSpace(l.root)
+}
+
+func (l *LocalStorage) Delete(name string) error {
+	path, err := l.path(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
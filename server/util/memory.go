@@ -0,0 +1,276 @@
+package util
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// MemoryStorage : files kept in memory, lost when the server exits; for tests and servers
+// that only pass files on
+type MemoryStorage struct {
+	lock  sync.Mutex
+	files map[string]*memData
+	// bytes the data of all files may take, 0 for no limit, and what it takes
+	capacity int64
+	used     int64
+}
+
+// memData : the content of a file, open files keep it even after it is renamed or deleted;
+// it is size bytes long, those past data were never written and read as zeros without taking
+// memory. data is not sparse, a write past its end fills the gap with zeros that count as used
+type memData struct {
+	data    []byte
+	size    int64
+	modTime time.Time
+	// removed from the storage, what open files still write is not counted
+	gone bool
+}
+
+var errFull = errors.New("memory storage full")
+
+// NewMemoryStorage : files in memory taking capacity bytes at most, 0 for no limit
+func NewMemoryStorage(capacity int64) *MemoryStorage {
+	return &MemoryStorage{
+		files:    make(map[string]*memData),
+		capacity: capacity,
+	}
+}
+
+// drop : d is no file of the storage any more
+func (m *MemoryStorage) drop(d *memData) {
+	m.used -= int64(len(d.data))
+	d.gone = true
+}
+
+func (m *MemoryStorage) Stat(name string) (os.FileInfo, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	d, exist := m.files[name]
+	if !exist {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return memInfo{name: path.Base(name), size: d.size, modTime: d.modTime}, nil
+}
+
+func (m *MemoryStorage) Open(name string, write bool) (File, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	d, exist := m.files[name]
+	if !exist {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return &memFile{storage: m, name: name, d: d, write: write}, nil
+}
+
+func (m *MemoryStorage) Create(name string) (File, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if old, exist := m.files[name]; exist {
+		m.drop(old)
+	}
+	d := &memData{modTime: time.Now()}
+	m.files[name] = d
+	return &memFile{storage: m, name: name, d: d, write: true}, nil
+}
+
+func (m *MemoryStorage) Rename(from, to string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	d, exist := m.files[from]
+	if !exist {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: os.ErrNotExist}
+	}
+	if old, exist := m.files[to]; exist && old != d {
+		m.drop(old)
+	}
+	delete(m.files, from)
+	m.files[to] = d
+	return nil
+}
+
+func (m *MemoryStorage) List() ([]string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	names := make([]string, 0, len(m.files))
+	for name := range m.files {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (m *MemoryStorage) Delete(name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	d, exist := m.files[name]
+	if !exist {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	m.drop(d)
+	delete(m.files, name)
+	return nil
+}
+
+// Free : what is left of the capacity, unknown without one
+func (m *MemoryStorage) Free() (int64, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.capacity == 0 {
+		return 0, false
+	}
+	return m.capacity - m.used, true
+}
+
+// memFile : an open file of a MemoryStorage, its data is guarded by the lock of the storage
+type memFile struct {
+	storage *MemoryStorage
+	name    string
+	d       *memData
+	offset  int64
+	write   bool
+	closed  bool
+}
+
+var errClosed = errors.New("file already closed")
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.storage.lock.Lock()
+	defer f.storage.lock.Unlock()
+	if f.closed {
+		return 0, errClosed
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= f.d.size {
+		return 0, io.EOF
+	}
+	var err error
+	if remain := f.d.size - off; int64(len(p)) > remain {
+		p = p[:remain]
+		err = io.EOF
+	}
+	n := 0
+	if off < int64(len(f.d.data)) {
+		n = copy(p, f.d.data[off:])
+	}
+	for i := n; i < len(p); i++ {
+		p[i] = 0
+	}
+	return len(p), err
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.storage.lock.Lock()
+	defer f.storage.lock.Unlock()
+	if f.closed {
+		return 0, errClosed
+	}
+	if !f.write {
+		return 0, os.ErrPermission
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	end := off + int64(len(p))
+	if grow := end - int64(len(f.d.data)); grow > 0 {
+		if !f.d.gone {
+			if f.storage.capacity > 0 && f.storage.used+grow > f.storage.capacity {
+				return 0, errFull
+			}
+			f.storage.used += grow
+		}
+		f.d.data = append(f.d.data, make([]byte, grow)...)
+	}
+	if end > f.d.size {
+		f.d.size = end
+	}
+	f.d.modTime = time.Now()
+	return copy(f.d.data[off:], p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.storage.lock.Lock()
+	defer f.storage.lock.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.d.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Close() error {
+	f.storage.lock.Lock()
+	defer f.storage.lock.Unlock()
+	if f.closed {
+		return errClosed
+	}
+	f.closed = true
+	return nil
+}
+
+// Sync : nothing survives a crash here anyway
+func (f *memFile) Sync() error {
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.storage.lock.Lock()
+	defer f.storage.lock.Unlock()
+	if f.closed {
+		return errClosed
+	}
+	if !f.write {
+		return os.ErrPermission
+	}
+	if size < 0 {
+		return errors.New("negative size")
+	}
+	if size < int64(len(f.d.data)) {
+		if !f.d.gone {
+			f.storage.used -= int64(len(f.d.data)) - size
+		}
+		f.d.data = f.d.data[:size]
+	}
+	f.d.size = size
+	f.d.modTime = time.Now()
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.storage.lock.Lock()
+	defer f.storage.lock.Unlock()
+	return memInfo{name: path.Base(f.name), size: f.d.size, modTime: f.d.modTime}, nil
+}
+
+// memInfo : os.FileInfo of a file of a MemoryStorage
+type memInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) Mode() os.FileMode  { return 0644 }
+func (i memInfo) ModTime() time.Time { return i.modTime }
+func (i memInfo) IsDir() bool        { return false }
+func (i memInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,72 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// CleanName : the file name from a client as a clean path relative to the storage path, with
+// / between its parts; false for an empty or absolute name, one with .. parts, NUL bytes or
+// invalid UTF-8, or one naming the part or state file of an upload or the temporary file of a state
+func CleanName(name string) (string, bool) {
+	if name == "" || !utf8.ValidString(name) || strings.IndexByte(name, 0) >= 0 {
+		return "", false
+	}
+	// a client on windows may send \ between parts, and nobody means to put one in a name
+	name = strings.ReplaceAll(name, "\\", "/")
+	if strings.HasPrefix(name, "/") || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", false
+	}
+	var parts []string
+	for _, part := range strings.Split(name, "/") {
+		switch part {
+		case "", ".":
+		case "..":
+			return "", false
+		default:
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) == 0 {
+		return "", false
+	}
+	last := parts[len(parts)-1]
+	if strings.HasSuffix(last, PartSuffix) || strings.HasSuffix(last, StateSuffix) ||
+		strings.HasSuffix(last, StateSuffix+TmpSuffix) {
+		return "", false
+	}
+	return strings.Join(parts, "/"), true
+}
+
+// StorageFile : path of the file with a name cleaned by CleanName under storagePath
+func StorageFile(storagePath, name string) string {
+	return filepath.Join(storagePath, filepath.FromSlash(name))
+}
+
+// InStorage : whether the file with a name cleaned by CleanName stays under storagePath once
+// symlinks are followed, as far as the path exists
+func InStorage(storagePath, name string) bool {
+	root, err := filepath.EvalSymlinks(storagePath)
+	if err != nil {
+		return false
+	}
+	path := StorageFile(storagePath, name)
+	for {
+		real, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			rel, err := filepath.Rel(root, real)
+			return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
+		}
+		if !os.IsNotExist(err) {
+			return false
+		}
+		// not created yet, what matters is where its directory is
+		dir := filepath.Dir(path)
+		if dir == path {
+			return false
+		}
+		path = dir
+	}
+}
@@ -0,0 +1,37 @@
+package util
+
+import "testing"
+
+func TestCleanName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"a.txt", "a.txt", true},
+		{"dir/a.txt", "dir/a.txt", true},
+		{"./dir//a.txt", "dir/a.txt", true},
+		{"dir\\a.txt", "dir/a.txt", true},
+		{"dir/./sub/", "dir/sub", true},
+		{"", "", false},
+		{".", "", false},
+		{"/etc/passwd", "", false},
+		{"\\etc\\passwd", "", false},
+		{"../a.txt", "", false},
+		{"dir/../../a.txt", "", false},
+		{"dir/../a.txt", "", false},
+		{"a\x00.txt", "", false},
+		{"a\xff.txt", "", false},
+		{"a.txt" + PartSuffix, "", false},
+		{"a.txt" + PartSuffix + StateSuffix, "", false},
+		{"a.txt" + PartSuffix + StateSuffix + TmpSuffix, "", false},
+		{"a" + PartSuffix + "/b.txt", "a" + PartSuffix + "/b.txt", true},
+		{"a.txt" + TmpSuffix, "a.txt" + TmpSuffix, true},
+	}
+	for _, test := range tests {
+		got, ok := CleanName(test.name)
+		if got != test.want || ok != test.ok {
+			t.Errorf("CleanName(%q) = %q, %v, want %q, %v", test.name, got, ok, test.want, test.ok)
+		}
+	}
+}
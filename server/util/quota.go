@@ -0,0 +1,142 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sync"
+)
+
+type stored struct {
+	user string
+	size int64
+}
+
+// Quota : how much may be uploaded, in a single file, by each user and before the storage gets
+// too full, 0 for no limit. Files are counted for the user who uploaded them,
+// as recorded in a usage file, uploads in progress for their declared size; safe for concurrent use
+type Quota struct {
+	store     Storage
+	maxSize   int64
+	userQuota int64
+	minFree   int64
+	// usage file, a line of user and file name quoted for every file stored
+	usage    string
+	lock     sync.Mutex
+	files    map[string]stored
+	used     map[string]int64
+	reserved map[string]int64
+	// all that is reserved, taken from the free space as if written already
+	pending int64
+}
+
+// LoadQuota : the quota with the files of the usage file that are still there counted
+func LoadQuota(store Storage, usage string, maxSize, userQuota, minFree int64) (*Quota, error) {
+	q := &Quota{
+		store:     store,
+		maxSize:   maxSize,
+		userQuota: userQuota,
+		minFree:   minFree,
+		usage:     usage,
+		files:     make(map[string]stored),
+		used:      make(map[string]int64),
+		reserved:  make(map[string]int64),
+	}
+	if usage == "" {
+		return q, nil
+	}
+	f, err := os.Open(usage)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var user, name string
+		if _, err := fmt.Sscanf(scanner.Text(), "%q %q", &user, &name); err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err.Error())
+		}
+		// the file may have been removed or replaced since
+		info, err := store.Stat(name)
+		if err != nil {
+			delete(q.files, name)
+			continue
+		}
+		q.files[name] = stored{user: user, size: info.Size()}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, file := range q.files {
+		q.used[file.user] += file.size
+	}
+	return q, nil
+}
+
+// Reserve : whether user may upload a file of size bytes, reserved until it is released or
+// committed; a per user quota needs the usage file
+func (q *Quota) Reserve(user string, size int64) bool {
+	if q.maxSize > 0 && size > q.maxSize {
+		return false
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.userQuota > 0 && q.used[user]+q.reserved[user]+size > q.userQuota {
+		return false
+	}
+	if free, ok := q.store.Free(); ok && q.minFree > 0 && free-q.pending-size < q.minFree {
+		return false
+	}
+	q.reserved[user] += size
+	q.pending += size
+	return true
+}
+
+// Release : an upload of size bytes by user ended without storing the file
+func (q *Quota) Release(user string, size int64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.release(user, size)
+}
+
+// Commit : the upload of size bytes by user was stored as the file name
+func (q *Quota) Commit(user, name string, size int64) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.release(user, size)
+	if old, ok := q.files[name]; ok {
+		q.used[old.user] -= old.size
+	}
+	q.files[name] = stored{user: user, size: size}
+	q.used[user] += size
+	if q.usage == "" {
+		return nil
+	}
+	f, err := os.OpenFile(q.usage, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%q %q\n", user, name)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// DiskLow : whether the free space of the storage less remaining bytes an upload still has to
+// write dropped below the minimum, files written by someone else count too
+func (q *Quota) DiskLow(remaining int64) bool {
+	free, ok := q.store.Free()
+	return ok && q.minFree > 0 && free-remaining < q.minFree
+}
+
+func (q *Quota) release(user string, size int64) {
+	q.reserved[user] -= size
+	if q.reserved[user] == 0 {
+		delete(q.reserved, user)
+	}
+	q.pending -= size
+}
@@ -0,0 +1,80 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestQuotaReserve(t *testing.T) {
+	// files of 100 bytes at most, 200 for each user, 600 of 1000 kept free
+	q, err := LoadQuota(NewMemoryStorage(1000), "", 100, 200, 600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		name string
+		do   func() bool
+		ok   bool
+	}{
+		{"too large", func() bool { return q.Reserve("alice", 101) }, false},
+		{"largest", func() bool { return q.Reserve("alice", 100) }, true},
+		{"up to the quota", func() bool { return q.Reserve("alice", 100) }, true},
+		{"past the quota", func() bool { return q.Reserve("alice", 1) }, false},
+		{"another user", func() bool { return q.Reserve("bob", 100) }, true},
+		{"down to the least free", func() bool { return q.Reserve("bob", 100) }, true},
+		{"past the least free", func() bool { return q.Reserve("carol", 1) }, false},
+		{"released", func() bool { q.Release("alice", 100); return q.Reserve("alice", 1) }, true},
+		// a stored file counts for its user instead of its reservation
+		{"stored", func() bool { q.Commit("alice", "a.bin", 100); return q.Reserve("alice", 100) }, false},
+		{"stored up to the quota", func() bool { return q.Reserve("alice", 99) }, true},
+		// a file stored again under the same name counts for the user who stored it last
+		{"replaced", func() bool { q.Commit("bob", "a.bin", 100); return q.Reserve("alice", 100) }, true},
+		{"replacing user", func() bool { return q.Reserve("bob", 1) }, false},
+	}
+	for _, step := range steps {
+		if ok := step.do(); ok != step.ok {
+			t.Errorf("%s: %v, want %v", step.name, ok, step.ok)
+		}
+	}
+	if q.DiskLow(400) || !q.DiskLow(401) {
+		t.Errorf("DiskLow does not keep 600 of 1000 bytes free")
+	}
+}
+
+func TestQuotaUsage(t *testing.T) {
+	store := NewMemoryStorage(0)
+	if err := WriteAtomic(store, "a.bin", make([]byte, 50)); err != nil {
+		t.Fatal(err)
+	}
+	usage := filepath.Join(t.TempDir(), "usage.txt")
+	if err := os.WriteFile(usage, []byte(`"alice" "a.bin"`+"\n"+`"alice" "gone.bin"`+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	q, err := LoadQuota(store, usage, 0, 200, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// files no longer there are not counted
+	if q.Reserve("alice", 151) || !q.Reserve("alice", 150) {
+		t.Errorf("alice is not counted for the 50 bytes of a.bin")
+	}
+	if err := q.Commit("alice", "b c.bin", 150); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(usage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(data), `"alice" "b c.bin"`+"\n") {
+		t.Errorf("usage file ends with %q", data)
+	}
+
+	if err := os.WriteFile(usage, []byte("alice a.bin\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadQuota(store, usage, 0, 200, 0); err == nil {
+		t.Errorf("usage line without quotes taken")
+	}
+}
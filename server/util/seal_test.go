@@ -0,0 +1,144 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+var (
+	clientAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000}
+	serverAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9091}
+)
+
+func testPsk(b byte) []byte {
+	return bytes.Repeat([]byte{b}, PskLen)
+}
+
+// sealedSession : a client and a server keyring that started upload session id, sealed with psk
+func sealedSession(t *testing.T, psk []byte, id uint64) (*Keyring, *Keyring) {
+	t.Helper()
+	client, err := NewKeyring(psk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewKeyring(psk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	initData := make([]byte, InitHeadLen)
+	initData[0] = UploadFlag | Init
+	ack, ok := server.Open(clientAddr, client.Seal(serverAddr, initData))
+	if !ok {
+		t.Fatal("init not opened")
+	}
+	ack[0] = UploadFlag | InitAck
+	binary.BigEndian.PutUint64(ack[MessIdIndex:MessIdIndex+8], id)
+	if _, ok := client.Open(serverAddr, server.Seal(clientAddr, ack)); !ok {
+		t.Fatal("init ack not opened")
+	}
+	return client, server
+}
+
+func chunkMessage(id uint64, index uint32) []byte {
+	data := make([]byte, NormalHeadLen+16)
+	data[0] = UploadFlag | Normal
+	binary.BigEndian.PutUint32(data[MessLenIndex:MessLenIndex+4], index)
+	binary.BigEndian.PutUint64(data[MessIdIndex:MessIdIndex+8], id)
+	copy(data[NormalHeadLen:], "chunk of a file.")
+	return data
+}
+
+func TestSealTamper(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(sealed []byte) []byte
+		ok     bool
+	}{
+		{"intact", func(sealed []byte) []byte { return sealed }, true},
+		{"head", func(sealed []byte) []byte { sealed[MessLenIndex] ^= 1; return sealed }, false},
+		{"nonce", func(sealed []byte) []byte { sealed[MessHeadLen+1] ^= 1; return sealed }, false},
+		{"body", func(sealed []byte) []byte { sealed[MessHeadLen+nonceLen] ^= 1; return sealed }, false},
+		{"tag", func(sealed []byte) []byte { sealed[len(sealed)-1] ^= 1; return sealed }, false},
+		{"short", func(sealed []byte) []byte { return sealed[:MessHeadLen+SealOverhead-1] }, false},
+	}
+	for _, test := range tests {
+		client, server := sealedSession(t, testPsk(1), 7)
+		data := chunkMessage(7, 3)
+		sealed := test.tamper(client.Seal(serverAddr, append([]byte(nil), data...)))
+		plain, ok := server.Open(clientAddr, sealed)
+		if ok != test.ok {
+			t.Errorf("%s: opened %v, want %v", test.name, ok, test.ok)
+		}
+		if ok && !bytes.Equal(plain, data) {
+			t.Errorf("%s: opened message differs", test.name)
+		}
+	}
+}
+
+func TestSealKeys(t *testing.T) {
+	client, server := sealedSession(t, testPsk(1), 7)
+	// the same session started again gets other salts, so another key
+	_, other := sealedSession(t, testPsk(1), 7)
+	// and another pre-shared key another master
+	_, stranger := sealedSession(t, testPsk(2), 7)
+	tests := []struct {
+		name   string
+		keys   *Keyring
+		addr   *net.UDPAddr
+		data   []byte
+		opened bool
+	}{
+		{"session", server, clientAddr, chunkMessage(7, 0), true},
+		{"other salts", other, clientAddr, chunkMessage(7, 0), false},
+		{"other psk", stranger, clientAddr, chunkMessage(7, 0), false},
+		{"other address", server, serverAddr, chunkMessage(7, 0), false},
+		// a message of no session is sealed with the handshake key
+		{"handshake key", server, clientAddr, chunkMessage(8, 0), true},
+		{"handshake key of another psk", stranger, clientAddr, chunkMessage(8, 0), false},
+	}
+	for _, test := range tests {
+		if _, ok := test.keys.Open(test.addr, client.Seal(serverAddr, test.data)); ok != test.opened {
+			t.Errorf("%s: opened %v, want %v", test.name, ok, test.opened)
+		}
+	}
+	if _, err := NewKeyring(testPsk(1)[:PskLen-1]); err == nil {
+		t.Errorf("short pre-shared key taken")
+	}
+}
+
+func TestSealReplay(t *testing.T) {
+	client, server := sealedSession(t, testPsk(1), 7)
+	sealed := make([][]byte, replayWindow+8)
+	for index := range sealed {
+		sealed[index] = client.Seal(serverAddr, chunkMessage(7, uint32(index)))
+	}
+	tests := []struct {
+		name   string
+		index  int
+		opened bool
+	}{
+		{"later", 10, true},
+		{"again", 10, false},
+		{"earlier in the window", 4, true},
+		{"earlier again", 4, false},
+		{"last", len(sealed) - 1, true},
+		{"behind the window", 5, false},
+		{"at the edge of the window", len(sealed) - replayWindow, true},
+	}
+	for _, test := range tests {
+		if _, ok := server.Open(clientAddr, sealed[test.index]); ok != test.opened {
+			t.Errorf("%s: opened %v, want %v", test.name, ok, test.opened)
+		}
+	}
+
+	// a message sent back to the side that sealed it
+	reflected := server.Seal(clientAddr, chunkMessage(7, 0))
+	if _, ok := server.Open(clientAddr, reflected); ok {
+		t.Errorf("reflected message opened")
+	}
+	if _, ok := client.Open(serverAddr, reflected); !ok {
+		t.Errorf("message of the server not opened")
+	}
+}
@@ -0,0 +1,88 @@
+package util
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// ErrOutside : the name leads out of the storage
+var ErrOutside = errors.New("outside of the storage")
+
+// File : an open file of a storage, chunks are read and written at their offsets
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	// Sync : what was written survives a crash once it returns
+	Sync() error
+	Truncate(size int64) error
+	Stat() (os.FileInfo, error)
+}
+
+// Storage : where the server keeps its files, by names cleaned by CleanName, and the part and
+// state files of uploads next to them
+type Storage interface {
+	// Stat : information on the file name, an error os.IsNotExist holds for if there is none,
+	// ErrOutside if name leads out of the storage
+	Stat(name string) (os.FileInfo, error)
+	// Open : open the file name, for writing too if write is set
+	Open(name string, write bool) (File, error)
+	// Create : create the file name, or empty it, for reading and writing
+	Create(name string) (File, error)
+	// Rename : move the file from to to, replacing what is there, durable once it returns
+	Rename(from, to string) error
+	// List : names of all files there are
+	List() ([]string, error)
+	// Delete : remove the file name
+	Delete(name string) error
+	// Free : bytes that can still be written, false if that is not known
+	Free() (int64, bool)
+}
+
+// ReadFile : all of the file name in store
+func ReadFile(store Storage, name string) ([]byte, error) {
+	f, err := store.Open(name, false)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// WriteAtomic : replace the file name in store by data, through a temporary file next to it,
+// so that after a crash name holds either the old or the new data
+func WriteAtomic(store Storage, name string, data []byte) error {
+	tmp := name + TmpSuffix
+	f, err := store.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(data, 0)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		store.Delete(tmp)
+		return err
+	}
+	return store.Rename(tmp, name)
+}
+
+// Outside : whether the name leads out of store, as a symlink on a local disk may
+func Outside(store Storage, name string) bool {
+	_, err := store.Stat(name)
+	return errors.Is(err, ErrOutside)
+}
+
+// Exists : whether there is a file name in store
+func Exists(store Storage, name string) bool {
+	_, err := store.Stat(name)
+	return err == nil
+}
@@ -0,0 +1,111 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestBitmap(t *testing.T) {
+	b := NewBitmap(20)
+	if len(b) != 3 {
+		t.Fatalf("NewBitmap(20) has %d bytes, want 3", len(b))
+	}
+	for _, index := range []uint32{0, 1, 7, 8, 19} {
+		b.Set(index)
+	}
+	for index := uint32(0); index < 20; index++ {
+		want := index == 0 || index == 1 || index == 7 || index == 8 || index == 19
+		if b.Has(index) != want {
+			t.Errorf("Has(%d) = %v, want %v", index, !want, want)
+		}
+	}
+	if got := b.Count(); got != 5 {
+		t.Errorf("Count() = %d, want 5", got)
+	}
+	if got := b.FirstClear(0); got != 2 {
+		t.Errorf("FirstClear(0) = %d, want 2", got)
+	}
+	b.Clear(1)
+	if b.Has(1) || b.Count() != 4 {
+		t.Errorf("Clear(1) left %d set", b.Count())
+	}
+	if got := b.FirstClear(0); got != 1 {
+		t.Errorf("FirstClear(0) = %d, want 1", got)
+	}
+	full := NewBitmap(16)
+	for index := uint32(0); index < 16; index++ {
+		full.Set(index)
+	}
+	if got := full.FirstClear(8); got != 16 {
+		t.Errorf("FirstClear of a full bitmap = %d, want 16", got)
+	}
+}
+
+func TestSackMessage(t *testing.T) {
+	const totalLen = MaxLen*8*2 + 5
+	b := NewBitmap(totalLen)
+	for index := uint32(0); index < 20; index++ {
+		b.Set(index)
+	}
+	b.Set(30)
+
+	// the bitmap starts at the byte holding base
+	data := SackMessage(b, 20)
+	if got := binary.BigEndian.Uint32(data[MessLenIndex : MessLenIndex+4]); got != 16 {
+		t.Errorf("base %d, want 16", got)
+	}
+	if len(data) != MessHeadLen+MaxLen {
+		t.Errorf("%d bytes, want %d", len(data), MessHeadLen+MaxLen)
+	}
+	if !bytes.Equal(data[MessHeadLen:], b[2:2+MaxLen]) {
+		t.Errorf("bitmap differs")
+	}
+	if SackAll(data, totalLen) {
+		t.Errorf("SackAll of a partial SACK")
+	}
+
+	// the tail is shorter than MaxLen
+	data = SackMessage(b, totalLen-1)
+	if len(data) != MessHeadLen+1 {
+		t.Errorf("%d bytes at the tail, want %d", len(data), MessHeadLen+1)
+	}
+
+	for index := uint32(0); index < totalLen; index++ {
+		b.Set(index)
+	}
+	data = SackMessage(b, b.FirstClear(0))
+	if !SackAll(data, totalLen) {
+		t.Errorf("SackAll of a full SACK is false")
+	}
+	data = SackMessage(b, totalLen-8)
+	if !SackAll(data, totalLen) {
+		t.Errorf("SackAll of the last chunks is false")
+	}
+	if SackAll(data, totalLen+8) {
+		t.Errorf("SackAll past the bitmap")
+	}
+}
+
+func TestChunkCount(t *testing.T) {
+	tests := []struct {
+		size      int64
+		chunkSize int
+		want      uint32
+		ok        bool
+	}{
+		{0, 1024, 1, true},
+		{1, 1024, 1, true},
+		{1024, 1024, 1, true},
+		{1025, 1024, 2, true},
+		{-1, 1024, 0, false},
+		{1024, 0, 0, false},
+		{1 << 42, 256, 0, false},
+	}
+	for _, test := range tests {
+		got, ok := ChunkCount(test.size, test.chunkSize)
+		if got != test.want || ok != test.ok {
+			t.Errorf("ChunkCount(%d, %d) = %d, %v, want %d, %v", test.size, test.chunkSize, got, ok, test.want, test.ok)
+		}
+	}
+}
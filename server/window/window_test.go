@@ -0,0 +1,138 @@
+package window
+
+import (
+	"server/util"
+	"testing"
+	"time"
+)
+
+// drain : every chunk Next hands out at now until the window is full
+func drain(s *Sender, now time.Time) []uint32 {
+	var out []uint32
+	for {
+		index, ok := s.Next(now)
+		if !ok {
+			return out
+		}
+		out = append(out, index)
+	}
+}
+
+func TestSenderWindow(t *testing.T) {
+	now := time.Now()
+	s := NewSender(100, 8, nil)
+	sent := drain(s, now)
+	if len(sent) != util.InitialCwnd {
+		t.Fatalf("%d chunks in flight at the start, want %d", len(sent), util.InitialCwnd)
+	}
+	for i, index := range sent {
+		if index != uint32(i) {
+			t.Fatalf("chunk %d sent as %d", i, index)
+		}
+	}
+	// slow start, every ack opens room for two
+	now = now.Add(time.Millisecond * 20)
+	s.Ack(0, now)
+	if more := drain(s, now); len(more) != 2 {
+		t.Errorf("%d chunks sent after an ack in slow start, want 2", len(more))
+	}
+	if s.srtt != time.Millisecond*20 {
+		t.Errorf("RTT %s, want 20ms", s.srtt)
+	}
+	if s.Ack(0, now) {
+		t.Errorf("chunk acked twice")
+	}
+
+	// the window never grows beyond its size
+	for index := uint32(1); index < 6; index++ {
+		s.Ack(index, now)
+	}
+	if more := drain(s, now); len(more) != 8 {
+		t.Errorf("%d chunks in flight, want the window of 8", len(more))
+	}
+
+	// chunks the peer has are not sent
+	acked := util.NewBitmap(10)
+	for index := uint32(0); index < 10; index += 2 {
+		acked.Set(index)
+	}
+	s = NewSender(10, 8, acked)
+	if s.Remain() != 5 {
+		t.Errorf("Remain() = %d, want 5", s.Remain())
+	}
+	for _, index := range drain(s, now) {
+		if index%2 == 0 {
+			t.Errorf("chunk %d the peer has was sent", index)
+		}
+	}
+}
+
+func TestSenderSack(t *testing.T) {
+	now := time.Now()
+	s := NewSender(20, 20, nil)
+	for index := uint32(0); index < 20; index++ {
+		s.cwnd = 20
+		s.Next(now)
+	}
+	// all below 8 and 9, 11 from there on
+	acked := util.NewBitmap(8)
+	acked.Set(1)
+	acked.Set(3)
+	if cnt := s.Sack(8, acked, now); cnt != 10 {
+		t.Errorf("Sack acked %d, want 10", cnt)
+	}
+	if cnt := s.Sack(8, acked, now); cnt != 0 {
+		t.Errorf("the same SACK acked %d again", cnt)
+	}
+	if s.Remain() != 10 {
+		t.Errorf("Remain() = %d, want 10", s.Remain())
+	}
+	full := util.NewBitmap(16)
+	for index := uint32(0); index < 16; index++ {
+		full.Set(index)
+	}
+	s.Sack(16, full, now)
+	if !s.Done() {
+		t.Errorf("not done once all chunks are acked, %d remain", s.Remain())
+	}
+}
+
+func TestSenderLoss(t *testing.T) {
+	now := time.Now()
+	s := NewSender(100, 16, nil)
+	s.cwnd = 8
+	sent := drain(s, now)
+	if len(sent) != 8 {
+		t.Fatalf("%d chunks in flight, want 8", len(sent))
+	}
+	// chunks sent DupThresh sends after chunk 0 arrived, it is taken as lost and sent first
+	for index := uint32(1); index <= util.DupThresh; index++ {
+		s.Ack(index, now)
+	}
+	index, ok := s.Next(now)
+	if !ok || index != 0 {
+		t.Fatalf("Next() = %d, %v after a fast retransmit, want 0", index, ok)
+	}
+	// the window was halved, and the resend counts against it
+	if s.cwnd >= 8 || s.inflight > int(s.cwnd) {
+		t.Errorf("cwnd %.1f with %d in flight after a loss", s.cwnd, s.inflight)
+	}
+
+	// nothing acked within the timeout, every chunk is lost and the window starts over
+	s = NewSender(100, 16, nil)
+	s.cwnd = 8
+	drain(s, now)
+	later := now.Add(util.InitialRTO)
+	resent := drain(s, later)
+	if len(resent) != 1 || resent[0] != 0 {
+		t.Errorf("sent %v after a timeout, want chunk 0 alone", resent)
+	}
+	if s.rto != util.InitialRTO*2 {
+		t.Errorf("RTO %s after a timeout, want it backed off to %s", s.rto, util.InitialRTO*2)
+	}
+	// a late ack of a chunk taken as lost does not free room twice
+	s.Ack(5, later)
+	if s.inflight != 1 {
+		t.Errorf("%d in flight, want the one resend", s.inflight)
+	}
+}